@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/manics/go-conda-proxy/repodata"
+)
+
+// explainAllowed describes why an allowed record is in the filtered repodata
+func explainAllowed(p *channelPipeline, filename string, record *repodata.RepodataRecord) string {
+	if p.policy.Allowed == nil {
+		return "no allowlist"
+	}
+	if spec := p.policy.Allowed.MatchingSpec(record); spec != nil {
+		return "allowlist entry: " + spec.String()
+	}
+	if lockfiles := p.lockedBy[filename]; len(lockfiles) > 0 {
+		return "pinned by lockfile: " + strings.Join(lockfiles, ", ")
+	}
+
+	platforms := []string{}
+	for platform := range p.closures {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	for _, platform := range platforms {
+		if chain := p.closures[platform].Chain(filename); chain != nil {
+			return fmt.Sprintf("required by allowed package (%s): %s", platform, strings.Join(chain, " -> "))
+		}
+	}
+	return "unknown"
+}
+
+// explainNotAllowed describes why a record isn't in the allowlist
+func explainNotAllowed(p *channelPipeline, record *repodata.RepodataRecord) string {
+	specs := []string{}
+	for _, spec := range p.policy.Allowed.Specs(record.Name) {
+		specs = append(specs, spec.String())
+	}
+	reason := "not in allowlist"
+	if len(specs) > 0 {
+		reason = "doesn't match allowlist entries: " + strings.Join(specs, " | ")
+	}
+	if p.closures != nil {
+		reason += ", not required by any allowed package"
+	}
+	return reason
+}
+
+// explain prints why the records matching a package name or filename in a
+// channel subdir are allowed or excluded
+//
+// Returns false if there are no matching records.
+func explain(cfg *repodata.CondaRepoConfig, channel string, subdir string, query string) bool {
+	if _, ok := cfg.Channels[channel]; !ok {
+		log.Fatalf("Unknown channel: %s", channel)
+	}
+
+	p := newChannelPipeline(cfg, channel)
+	p.resolveDependencies()
+	data := p.loadSubdir(subdir)
+
+	records := make(map[string]repodata.RepodataRecord)
+	for _, packages := range []map[string]repodata.RepodataRecord{data.Packages, data.PackagesConda} {
+		for k, v := range packages {
+			if k == query || v.Name == query {
+				records[k] = v
+			}
+		}
+	}
+
+	if len(records) == 0 {
+		found := false
+		for _, k := range data.Removed {
+			if name, _, _, ok := repodata.ParsePackageFilename(k); k == query || (ok && name == query) {
+				fmt.Printf("%s/%s: removed from channel\n", subdir, k)
+				found = true
+			}
+		}
+		if !found {
+			fmt.Printf("%s: not found in %s/%s\n", query, channel, subdir)
+		}
+		return found
+	}
+
+	filtered, exclusions := repodata.FilterRepodataByAllowed(data, p.policy)
+	excluded := make(map[string]repodata.Exclusion)
+	for _, e := range exclusions {
+		excluded[e.Filename] = e
+	}
+
+	filenames := []string{}
+	for k := range records {
+		filenames = append(filenames, k)
+	}
+	sort.Strings(filenames)
+
+	for _, k := range filenames {
+		record := records[k]
+		filename := subdir + "/" + k
+		_, inPackages := filtered.Packages[k]
+		_, inPackagesConda := filtered.PackagesConda[k]
+
+		if e, ok := excluded[k]; ok {
+			fmt.Printf("%s: excluded [%s] %s\n", filename, e.Rule, e.Reason)
+		} else if inPackages || inPackagesConda {
+			fmt.Printf("%s: allowed, %s\n", filename, explainAllowed(p, filename, &record))
+		} else if rule, reason := p.policy.CheckRules(filename, &record); rule != "" {
+			// Records excluded by a rule can't be required by an allowed package
+			fmt.Printf("%s: excluded [%s] %s, %s\n", filename, rule, reason, explainNotAllowed(p, &record))
+		} else {
+			fmt.Printf("%s: excluded [%s] %s\n", filename, repodata.RuleNotAllowed, explainNotAllowed(p, &record))
+		}
+	}
+	return true
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"bytes"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -13,30 +14,55 @@ import (
 	"github.com/manics/go-conda-proxy/repodata"
 )
 
-func writeSortedSet(outputFilename string, s *repodata.Set) {
+// Number of patches kept in the filtered repodata.jlap, it's trimmed to this
+// once it has twice as many
+const JLAP_MAX_PATCHES = 30
+
+func writeLines(outputFilename string, lines []string) {
 	log.Println("Writing", outputFilename)
-	output, err := os.Create(outputFilename)
-	if err != nil {
-		log.Fatalf("Error opening file: %s", err)
+
+	var output bytes.Buffer
+	for _, line := range lines {
+		output.WriteString(line + "\n")
+	}
+	if err := repodata.WriteTempAndRename(&output, outputFilename); err != nil {
+		log.Fatalf("Error writing to file: %s", err)
 	}
-	defer output.Close()
+	log.Println("Output written to", outputFilename)
+}
 
+func writeSortedSet(outputFilename string, s *repodata.Set) {
 	items := *s.Items()
 	sort.Strings(items)
-	for _, item := range items {
-		if _, err := output.WriteString(item + "\n"); err != nil {
-			log.Fatalf("Error writing to file: %s", err)
-		}
+	writeLines(outputFilename, items)
+}
+
+// writeLargestExcluded writes the records excluded by the size policy, largest first
+func writeLargestExcluded(outputFilename string, exclusions map[string]repodata.Exclusion) {
+	filenames := []string{}
+	for k := range exclusions {
+		filenames = append(filenames, k)
 	}
-	log.Println("Output written to", outputFilename)
+	sort.Slice(filenames, func(i, j int) bool {
+		a, b := exclusions[filenames[i]].Record.Size, exclusions[filenames[j]].Record.Size
+		return a > b || (a == b && filenames[i] < filenames[j])
+	})
+	lines := []string{}
+	for _, k := range filenames {
+		lines = append(lines, fmt.Sprintf("%s\t%d\t%s", k, exclusions[k].Record.Size, exclusions[k].Reason))
+	}
+	writeLines(outputFilename, lines)
 }
 
 func main() {
-	allFileNames := repodata.NewSet(nil)
-	allPackageNames := repodata.NewSet(nil)
-
 	configFile := flag.String("cfg", "", "Configuration file")
 	forceUpdate := flag.Bool("force", false, "Force update")
+	tenant := flag.String("tenant", "", "Explain the filters of this tenant")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -cfg config.yaml [-force]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -cfg config.yaml [-tenant name] explain <channel> <subdir> <package-or-filename>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if *configFile == "" {
@@ -48,46 +74,91 @@ func main() {
 		log.Fatalf("Failed to load configuration file: %s", err)
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "explain":
+		if flag.NArg() != 4 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if *tenant != "" {
+			if cfg, err = cfg.Tenant(*tenant); err != nil {
+				log.Fatalf("Invalid tenant: %s", err)
+			}
+		}
+		// Uses the previously downloaded repodata
+		if !explain(cfg, flag.Arg(1), flag.Arg(2), flag.Arg(3)) {
+			os.Exit(1)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Tenants share the upstream repodata but have their own filtered repodata
+	tenants := []*repodata.CondaRepoConfig{}
+	for _, name := range cfg.TenantNames() {
+		tenantCfg, err := cfg.Tenant(name)
+		if err != nil {
+			log.Fatalf("Invalid tenant: %s", err)
+		}
+		tenants = append(tenants, tenantCfg)
+	}
+
 	err = repodata.UpdateFromConfig(cfg, *forceUpdate)
 	if err != nil {
 		log.Fatalf("Failed to update repodata: %s", err)
 	}
+	filterChannels(cfg)
+	for _, tenantCfg := range tenants {
+		log.Printf("tenant:[%s]", tenantCfg.FilteredRepodataDir)
+		filterChannels(tenantCfg)
+	}
+}
 
-	outputPrefix := cfg.FilteredRepodataDir
+// filterChannels filters the repodata for all channels and writes the filtered
+// repodata and reports
+func filterChannels(cfg *repodata.CondaRepoConfig) {
+	allFileNames := repodata.NewSet(nil)
+	allPackageNames := repodata.NewSet(nil)
+	blockedByAdvisory := repodata.NewSet(nil)
+	checksums := repodata.NewSet(nil)
 
-	var allowedPackages *repodata.Set = nil
-	var filteredRepodata map[string]*repodata.Repodata = make(map[string]*repodata.Repodata)
+	outputPrefix := cfg.FilteredRepodataDir
 
 	for channel, channelCfg := range cfg.Channels {
-		dependencyMap := map[string]repodata.Set{}
-
-		log.Printf("channel:[%s] channelCfg:[%+v]", channel, channelCfg)
-		if channelCfg.AllowlistFile != "" {
-			allowedPackages = repodata.ParseListFromFile(channelCfg.AllowlistFile)
-			log.Printf("allowedPackages:[%d]", allowedPackages.Len())
-		}
-
+		p := newChannelPipeline(cfg, channel)
+		missingDependencies, deniedDependencies := p.resolveDependencies()
 		if channelCfg.RecurseDependencies {
-			for _, subdir := range channelCfg.Subdirs {
-				file := repodata.GetDestinationFilename(cfg.OriginalRepodataDir, channel, subdir, ".json")
-				log.Printf("Updating dependency map from %s", file)
-				if data, err := repodata.LoadRepodata(file); err != nil {
-					log.Fatalf("Error loading repodata: %s", err)
-				} else {
-					repodata.UpdateDependencyMap(&dependencyMap, data)
-				}
+			// Dependencies that can't be satisfied by any allowed record
+			writeSortedSet(p.outputFilename("missing-dependencies.txt"), missingDependencies)
+			if p.policy.Denied != nil {
+				writeSortedSet(p.outputFilename("denied-dependencies.txt"), deniedDependencies)
 			}
-			allowedPackages = repodata.GetChannelPackageDependencies(dependencyMap, allowedPackages)
 		}
 
+		excluded := repodata.NewSet(nil)
+		excludedBySize := make(map[string]repodata.Exclusion)
+		filteredRepodata := make(map[string]*repodata.Repodata)
+
 		for _, subdir := range channelCfg.Subdirs {
-			file := repodata.GetDestinationFilename(cfg.OriginalRepodataDir, channel, subdir, ".json")
-			filtered, fileNames, packageNames, err := repodata.ParseRepodata(channel, file, allowedPackages)
-			if err != nil {
-				log.Fatalf("Error parsing repodata: %s", err)
+			filtered, fileNames, packageNames, exclusions := repodata.FilterRepodata(channel, p.loadSubdir(subdir), p.policy)
+			for _, e := range exclusions {
+				excluded.Add(subdir + "/" + e.Filename + "\t" + e.Rule + "\t" + e.Reason)
+				if e.Rule == repodata.RuleAdvisory {
+					blockedByAdvisory.Add(channel + "/" + subdir + "/" + e.Filename + "\t" + e.Reason)
+				}
+				if e.Rule == repodata.RuleSize {
+					excludedBySize[subdir+"/"+e.Filename] = e
+				}
 			}
 
-			filteredRepodata[filtered.Info.Subdir] = filtered
+			filteredRepodata[subdir] = filtered
+			// conda-proxy verifies packages against these without loading the repodata
+			for k, v := range repodata.PackageChecksums(channel, filtered) {
+				checksums.Add(k + "\t" + v.String())
+			}
 			for _, k := range *fileNames.Items() {
 				allFileNames.Add(k)
 			}
@@ -101,19 +172,41 @@ func main() {
 				log.Fatalf("Error encoding JSON: %s", err)
 			}
 
+			// The previous version is needed for the jlap patch
+			previous, err := os.ReadFile(filteredFile)
+			if err != nil && !os.IsNotExist(err) {
+				log.Fatalf("Error reading file: %s", err)
+			}
+
 			err = repodata.WriteTempAndRename(bytes.NewReader(data), filteredFile)
 			if err != nil {
 				log.Fatalf("Error writing file: %s", err)
 			}
 
+			jlapFile := repodata.GetDestinationFilename(outputPrefix, channel, subdir, ".jlap")
+			if err := repodata.UpdateJLAPFile(jlapFile, previous, data, JLAP_MAX_PATCHES); err != nil {
+				log.Fatalf("Error writing jlap: %s", err)
+			}
+
 			if err := repodata.ZstdCompress(filteredFile, filteredFile+".zst"); err != nil {
 				log.Fatalf("Error compressing file: %s", err)
 			}
 		}
+
+		writeSortedSet(p.outputFilename("excluded.txt"), excluded)
+		if channelCfg.MaxPackageSizeMB > 0 || len(channelCfg.MaxPackageSizeOverrides) > 0 {
+			writeLargestExcluded(p.outputFilename("largest-excluded.txt"), excludedBySize)
+		}
+
+		// Report constraints that can never be met by the filtered repodata, since
+		// they'll cause the solver to fail if both packages are requested
+		writeSortedSet(p.outputFilename("unsatisfiable-constrains.txt"), p.unsatisfiableConstrains(filteredRepodata))
+		writeSortedSet(p.outputFilename("patches.txt"), p.appliedPatches)
 	}
 	log.Printf("fileNames:[%d] packageNames:[%d]", allFileNames.Len(), allPackageNames.Len())
 
-	// TODO: use WriteTempAndRename
 	writeSortedSet(filepath.Join(outputPrefix, "filenames.txt"), allFileNames)
 	writeSortedSet(filepath.Join(outputPrefix, "packagenames.txt"), allPackageNames)
+	writeSortedSet(filepath.Join(outputPrefix, "advisories.txt"), blockedByAdvisory)
+	writeSortedSet(filepath.Join(outputPrefix, "checksums.txt"), checksums)
 }
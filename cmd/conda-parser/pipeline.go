@@ -0,0 +1,264 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/manics/go-conda-proxy/repodata"
+	"golang.org/x/exp/slices"
+)
+
+// channelPipeline holds the policy and state used to filter a channel
+type channelPipeline struct {
+	cfg     *repodata.CondaRepoConfig
+	channel string
+	policy  *repodata.FilterPolicy
+	patches map[string]*repodata.PatchInstructions
+	// Packages from this channel in the lockfiles
+	locked []repodata.LockedPackage
+	// Lockfiles pinning each locked package, indexed by "subdir/filename"
+	lockedBy map[string][]string
+	// Patches applied by loadSubdir, "subdir/filename\taction"
+	appliedPatches *repodata.Set
+	// Dependency closures indexed by platform subdir, nil if dependencies aren't recursed
+	closures map[string]*repodata.DependencyClosure
+}
+
+// newChannelPipeline loads the filter policy and patch instructions for a channel
+func newChannelPipeline(cfg *repodata.CondaRepoConfig, channel string) *channelPipeline {
+	channelCfg := cfg.Channels[channel]
+	var err error
+
+	var allowedPackages *repodata.PackageList = nil
+	log.Printf("channel:[%s] channelCfg:[%+v]", channel, channelCfg)
+	if channelCfg.AllowlistFile != "" {
+		allowedPackages, err = repodata.ParsePackageListFromFile(channelCfg.AllowlistFile)
+		if err != nil {
+			log.Fatalf("Error loading allowlist: %s", err)
+		}
+		log.Printf("allowedPackages:[%d]", allowedPackages.Len())
+	}
+	// Conda dependencies of environment files are added to the allowlist
+	for _, path := range channelCfg.EnvironmentFiles {
+		envs, err := repodata.LoadEnvironments(path)
+		if err != nil {
+			log.Fatalf("Error loading environment files: %s", err)
+		}
+		if allowedPackages == nil {
+			allowedPackages = repodata.NewPackageList()
+		}
+		for _, env := range envs {
+			specs, err := env.Specs(channel)
+			if err != nil {
+				log.Fatalf("Error parsing environment file: %s", err)
+			}
+			for _, spec := range specs {
+				allowedPackages.Add(spec)
+			}
+			log.Printf("environment:[%s] specs:[%d] pip:[%d]", env.Filename, len(specs), len(env.PipDependencies))
+		}
+	}
+
+	locked := []repodata.LockedPackage{}
+	lockedFiles := repodata.NewSet(nil)
+	lockedBy := make(map[string][]string)
+	for _, lockfile := range channelCfg.Lockfiles {
+		packages, err := repodata.LoadLockfile(lockfile)
+		if err != nil {
+			log.Fatalf("Error loading lockfile: %s", err)
+		}
+		n := 0
+		for _, pkg := range packages {
+			// Packages from other channels, hosts or mirrors are for other channel configs
+			if !pkg.InChannel(cfg.CondaHost, channel) {
+				if strings.HasPrefix(pkg.Channel, channel+"/label/") {
+					log.Printf("WARNING: locked package from a label isn't served: %s", pkg.URL)
+				}
+				continue
+			}
+			if !slices.Contains(channelCfg.Subdirs, pkg.Subdir) {
+				log.Printf("WARNING: locked package subdir isn't configured: %s", pkg.URL)
+				continue
+			}
+			locked = append(locked, pkg)
+			lockedFiles.Add(pkg.Path())
+			if !slices.Contains(lockedBy[pkg.Path()], lockfile) {
+				lockedBy[pkg.Path()] = append(lockedBy[pkg.Path()], lockfile)
+			}
+			n++
+		}
+		log.Printf("lockfile:[%s] packages:[%d] other:[%d]", lockfile, n, len(packages)-n)
+	}
+
+	var deniedPackages *repodata.PackageList = nil
+	if channelCfg.DenylistFile != "" {
+		deniedPackages, err = repodata.ParsePackageListFromFile(channelCfg.DenylistFile)
+		if err != nil {
+			log.Fatalf("Error loading denylist: %s", err)
+		}
+		log.Printf("deniedPackages:[%d]", deniedPackages.Len())
+	}
+
+	policy := &repodata.FilterPolicy{
+		Allowed:     allowedPackages,
+		LockedFiles: lockedFiles,
+		Denied:      deniedPackages,
+		MinAge:      time.Duration(channelCfg.MinAgeDays) * 24 * time.Hour,
+		Now:         time.Now(),
+		PreferConda: channelCfg.PreferConda,
+	}
+	if len(channelCfg.MinAgeExempt) > 0 {
+		policy.MinAgeExempt, err = repodata.ParsePackageList(channelCfg.MinAgeExempt)
+		if err != nil {
+			log.Fatalf("Error parsing min_age_exempt: %s", err)
+		}
+	}
+	if lp := channelCfg.LicensePolicy; lp != nil {
+		policy.License, err = repodata.NewLicensePolicy(lp.Allow, lp.AllowOsiApproved, lp.Deny, lp.Fallback)
+		if err != nil {
+			log.Fatalf("Error parsing license_policy: %s", err)
+		}
+	}
+	if bp := channelCfg.BuildPolicy; bp != nil {
+		policy.Builds, err = repodata.NewBuildPolicy(bp.Exclude, bp.Include, bp.ExcludeTrackFeatures)
+		if err != nil {
+			log.Fatalf("Error parsing build_policy: %s", err)
+		}
+	}
+	if channelCfg.MaxPackageSizeMB > 0 || len(channelCfg.MaxPackageSizeOverrides) > 0 {
+		policy.Sizes, err = repodata.NewSizePolicy(channelCfg.MaxPackageSizeMB, channelCfg.MaxPackageSizeOverrides)
+		if err != nil {
+			log.Fatalf("Error parsing max_package_size_mb: %s", err)
+		}
+	}
+	if len(channelCfg.VirtualPackages) > 0 {
+		policy.VirtualPackages, err = repodata.NewPlatformVirtualPackageProfiles(channelCfg.Subdirs, channelCfg.VirtualPackages)
+		if err != nil {
+			log.Fatalf("Error parsing virtual_packages: %s", err)
+		}
+	}
+	if r := channelCfg.Retention; r != nil {
+		policy.Retention = &repodata.RetentionPolicy{
+			KeepVersions: r.KeepVersions,
+			KeepMonths:   r.KeepMonths,
+			KeepBuilds:   r.KeepBuilds,
+		}
+	}
+	if cfg.AdvisoriesDir != "" {
+		policy.Advisories, err = repodata.LoadAdvisoryDatabase(cfg.AdvisoriesDir, channel)
+		if err != nil {
+			log.Fatalf("Error loading advisories: %s", err)
+		}
+		log.Printf("advisories:[%d]", policy.Advisories.Len())
+	}
+
+	patches := make(map[string]*repodata.PatchInstructions)
+	for subdir, patchFile := range channelCfg.PatchInstructions {
+		patches[subdir], err = repodata.LoadPatchInstructions(patchFile)
+		if err != nil {
+			log.Fatalf("Error loading patch instructions: %s", err)
+		}
+	}
+
+	return &channelPipeline{
+		cfg:            cfg,
+		channel:        channel,
+		policy:         policy,
+		patches:        patches,
+		locked:         locked,
+		lockedBy:       lockedBy,
+		appliedPatches: repodata.NewSet(nil),
+	}
+}
+
+// loadSubdir loads a subdir's original repodata, checks the locked packages
+// and applies any patch instructions
+func (p *channelPipeline) loadSubdir(subdir string) *repodata.Repodata {
+	file := repodata.GetDestinationFilename(p.cfg.OriginalRepodataDir, p.channel, subdir, ".json")
+	log.Println("Loading", file)
+	data, err := repodata.LoadRepodata(file)
+	if err != nil {
+		log.Fatalf("Error loading repodata: %s", err)
+	}
+	missing, err := repodata.CheckLockedPackages(data, p.locked)
+	if err != nil {
+		log.Fatalf("Error checking lockfiles: %s", err)
+	}
+	if len(missing) > 0 {
+		// The locked environments can't be installed through the proxy
+		log.Fatalf("Error checking lockfiles: locked packages not found in %s: %s", p.channel, strings.Join(missing, ", "))
+	}
+	if patches, ok := p.patches[subdir]; ok {
+		applied, err := patches.Apply(data)
+		if err != nil {
+			log.Fatalf("Error applying patch instructions: %s", err)
+		}
+		log.Printf("subdir:[%s] patches:[%d]", subdir, len(applied))
+		for _, a := range applied {
+			p.appliedPatches.Add(subdir + "/" + a.Filename + "\t" + a.Action)
+		}
+	}
+	return data
+}
+
+// resolveDependencies computes the dependency closure of the allowlist for each
+// platform subdir if the channel recurses dependencies, and adds them to the
+// policy's allowed files
+//
+// Returns the dependencies that can't be satisfied, "subdir\troot\tfilename\tdependency\trule",
+// and the roots that depend on denied packages, "root\tdenied names".
+func (p *channelPipeline) resolveDependencies() (*repodata.Set, *repodata.Set) {
+	channelCfg := p.cfg.Channels[p.channel]
+	missingDependencies := repodata.NewSet(nil)
+	deniedDependencies := repodata.NewSet(nil)
+	if !channelCfg.RecurseDependencies || p.policy.Allowed == nil {
+		return missingDependencies, deniedDependencies
+	}
+
+	deps := repodata.ResolvePlatformDependencies(channelCfg.Subdirs, p.loadSubdir, p.policy.Allowed, p.policy, channelCfg.IncludeConstrains)
+	p.policy.AllowedFiles = deps.Filenames
+	p.closures = deps.Closures
+	for subdir, closure := range deps.Closures {
+		for _, m := range closure.Missing {
+			missingDependencies.Add(subdir + "\t" + closure.Root(m.Filename) + "\t" + m.Filename + "\t" + m.Dependency + "\t" + m.Rule)
+		}
+	}
+
+	// The denylist is applied after dependencies are expanded, so report which
+	// roots have dependencies that will be missing
+	for root, denied := range deps.Denied {
+		deniedNames := *denied.Items()
+		sort.Strings(deniedNames)
+		log.Printf("Allowed package %s depends on denied packages: %s", root, strings.Join(deniedNames, " "))
+		deniedDependencies.Add(root + "\t" + strings.Join(deniedNames, " "))
+	}
+	return missingDependencies, deniedDependencies
+}
+
+// unsatisfiableConstrains returns the constraints that can never be met by the
+// filtered repodata for each platform subdir, "subdir\tfilename\tconstraint"
+func (p *channelPipeline) unsatisfiableConstrains(filteredRepodata map[string]*repodata.Repodata) *repodata.Set {
+	unsatisfiable := repodata.NewSet(nil)
+	platforms, includeNoarch := repodata.PlatformSubdirs(p.cfg.Channels[p.channel].Subdirs)
+	for _, subdir := range platforms {
+		idx := repodata.NewPackageIndex()
+		if includeNoarch {
+			idx.Add(filteredRepodata["noarch"], nil)
+		}
+		if subdir != "noarch" {
+			idx.Add(filteredRepodata[subdir], nil)
+		}
+		for _, u := range idx.UnsatisfiableConstrains() {
+			unsatisfiable.Add(subdir + "\t" + u.Filename + "\t" + u.Constraint)
+		}
+	}
+	return unsatisfiable
+}
+
+// outputFilename returns the path of a report file for the channel
+func (p *channelPipeline) outputFilename(name string) string {
+	return filepath.Join(p.cfg.FilteredRepodataDir, p.channel, name)
+}
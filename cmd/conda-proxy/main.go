@@ -2,12 +2,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,16 +34,86 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-type proxy struct {
+// tenant is a set of filtered channels generated by conda-parser
+type tenant struct {
+	Name             string
 	AllowedFilenames *repodata.Set
-	Cfg              *repodata.CondaRepoConfig
+	// Filenames blocked by a security advisory, mapped to the advisory IDs
+	BlockedFilenames map[string]string
+	// Expected checksums of the allowed files, from checksums.txt written by conda-parser
+	Checksums map[string]repodata.PackageChecksum
+	Cfg       *repodata.CondaRepoConfig
+}
+
+type proxy struct {
+	// The top-level channels, served without a prefix
+	Default *tenant
+	// Tenants served under /<name>/
+	Tenants map[string]*tenant
+	// Tenants served under /t/<token>/
+	Tokens map[string]*tenant
+	Cfg    *repodata.CondaRepoConfig
+}
+
+// loadTenant loads the allowed and blocked filenames written by conda-parser
+func loadTenant(name string, cfg *repodata.CondaRepoConfig) *tenant {
+	allowedFilelistName := filepath.Join(cfg.FilteredRepodataDir, "filenames.txt")
+	allowedFilenames := repodata.ParseListFromFile(allowedFilelistName)
+	log.Printf("Loaded %d allowed filenames from %s", allowedFilenames.Len(), allowedFilelistName)
+
+	blockedFilenames := make(map[string]string)
+	blockedFilelistName := filepath.Join(cfg.FilteredRepodataDir, "advisories.txt")
+	if _, err := os.Stat(blockedFilelistName); err == nil {
+		for _, line := range *repodata.ParseListFromFile(blockedFilelistName).Items() {
+			if filename, advisories, found := strings.Cut(line, "\t"); found {
+				blockedFilenames[filename] = advisories
+			}
+		}
+		log.Printf("Loaded %d blocked filenames from %s", len(blockedFilenames), blockedFilelistName)
+	}
+
+	checksumsName := filepath.Join(cfg.FilteredRepodataDir, "checksums.txt")
+	checksums, err := repodata.LoadPackageChecksums(checksumsName)
+	if err != nil {
+		log.Fatalf("Error loading checksums, run conda-parser to create them: %s", err)
+	}
+	log.Printf("Loaded %d checksums from %s", len(checksums), checksumsName)
+
+	return &tenant{
+		Name:             name,
+		AllowedFilenames: allowedFilenames,
+		BlockedFilenames: blockedFilenames,
+		Checksums:        checksums,
+		Cfg:              cfg,
+	}
+}
+
+// selectTenant returns the tenant for a request path, the path without the
+// tenant prefix, and the path with any token redacted for logging
+//
+// Returns a nil tenant if the token is unknown.
+func (p *proxy) selectTenant(path string) (*tenant, string, string) {
+	pathParts := strings.SplitN(path, "/", 4)
+	if len(pathParts) == 4 && pathParts[0] == "" && pathParts[1] == "t" {
+		logPath := "/t/<token>/" + pathParts[3]
+		if t, ok := p.Tokens[pathParts[2]]; ok {
+			return t, "/" + pathParts[3], logPath
+		}
+		return nil, "", logPath
+	}
+	if len(pathParts) >= 3 && pathParts[0] == "" {
+		if t, ok := p.Tenants[pathParts[1]]; ok {
+			return t, "/" + strings.Join(pathParts[2:], "/"), path
+		}
+	}
+	return p.Default, path, path
 }
 
 func httpLogPrefix(req *http.Request) string {
 	return strings.Split(req.RemoteAddr, ":")[0]
 }
 
-func (p *proxy) serveRepodata(wr http.ResponseWriter, req *http.Request, channel string, subdir string, filename string) {
+func (p *proxy) serveRepodata(wr http.ResponseWriter, req *http.Request, t *tenant, channel string, subdir string, filename string) {
 	logPrefix := httpLogPrefix(req)
 	filePath := strings.Join([]string{channel, subdir, filename}, "/")
 
@@ -51,27 +124,32 @@ func (p *proxy) serveRepodata(wr http.ResponseWriter, req *http.Request, channel
 		suffix = ".json"
 	} else if filename == "repodata.json.zst" {
 		suffix = ".json.zst"
+	} else if filename == "repodata.jlap" {
+		suffix = ".jlap"
 	} else {
-		msg := "Invalid path: " + req.URL.Path
+		msg := "Invalid path: " + filePath
 		http.Error(wr, msg, http.StatusNotFound)
 		log.Println(logPrefix, http.StatusNotFound, msg)
 		return
 	}
 
-	_, ok := p.Cfg.Channels[channel]
-	if !ok || !slices.Contains(p.Cfg.Channels[channel].Subdirs, subdir) {
+	_, ok := t.Cfg.Channels[channel]
+	if !ok || !slices.Contains(t.Cfg.Channels[channel].Subdirs, subdir) {
 		msg := "Invalid channel/subdir: " + filePath
 		http.Error(wr, msg, http.StatusNotFound)
 		log.Println(logPrefix, http.StatusNotFound, msg)
 		return
 	}
 
-	localPath := repodata.GetDestinationFilename(p.Cfg.FilteredRepodataDir, channel, subdir, suffix)
+	localPath := repodata.GetDestinationFilename(t.Cfg.FilteredRepodataDir, channel, subdir, suffix)
 
 	if strings.HasSuffix(filename, ".zst") {
 		wr.Header().Set("Content-Type", "application/zstd")
 	} else if strings.HasSuffix(filename, ".json") {
 		wr.Header().Set("Content-Type", "application/json")
+	} else if strings.HasSuffix(filename, ".jlap") {
+		// Clients fetch new lines with Range requests, handled by http.ServeFile
+		wr.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	} else {
 		msg := "Unexpected file extension: " + filename
 		http.Error(wr, msg, http.StatusUnsupportedMediaType)
@@ -85,7 +163,18 @@ func (p *proxy) serveRepodata(wr http.ResponseWriter, req *http.Request, channel
 
 func (p *proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 	logPrefix := httpLogPrefix(req)
-	log.Println(logPrefix, req.Method, req.URL, req.UserAgent())
+	t, path, logPath := p.selectTenant(req.URL.Path)
+	if t != nil && t.Name != "" {
+		logPrefix += " [" + t.Name + "]"
+	}
+	log.Println(logPrefix, req.Method, logPath, req.UserAgent())
+
+	if t == nil {
+		msg := "Invalid token: " + logPath
+		http.Error(wr, msg, http.StatusNotFound)
+		log.Println(logPrefix, http.StatusNotFound, msg)
+		return
+	}
 
 	if req.Method != "GET" && req.Method != "HEAD" {
 		msg := "Invalid method: " + req.Method
@@ -94,31 +183,49 @@ func (p *proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	pathParts := strings.Split(req.URL.Path, "/")
+	pathParts := strings.Split(path, "/")
 	filePath := strings.Join(pathParts[1:], "/")
 	// first element should be empty due to the leading /
 	if pathParts[0] != "" {
-		msg := "Invalid filepath: " + req.URL.Path
+		msg := "Invalid filepath: " + logPath
 		http.Error(wr, msg, http.StatusNotFound)
 		log.Println(logPrefix, http.StatusNotFound, msg)
 	}
 
 	if len(pathParts) == 4 &&
-		(strings.HasSuffix(pathParts[3], ".json") || strings.HasSuffix(pathParts[3], ".json.zst")) {
-		p.serveRepodata(wr, req, pathParts[1], pathParts[2], pathParts[3])
+		(strings.HasSuffix(pathParts[3], ".json") || strings.HasSuffix(pathParts[3], ".json.zst") ||
+			strings.HasSuffix(pathParts[3], ".jlap")) {
+		p.serveRepodata(wr, req, t, pathParts[1], pathParts[2], pathParts[3])
 		return
 	}
 
-	if p.AllowedFilenames != nil && !p.AllowedFilenames.Contains(filePath) {
-		msg := "Invalid filepath: " + req.URL.Path
+	if advisories, ok := t.BlockedFilenames[filePath]; ok {
+		msg := "Blocked by security advisory " + advisories + ": " + logPath
+		http.Error(wr, msg, http.StatusForbidden)
+		log.Println(logPrefix, http.StatusForbidden, msg)
+		return
+	}
+
+	if t.AllowedFilenames != nil && !t.AllowedFilenames.Contains(filePath) {
+		msg := "Invalid filepath: " + logPath
 		http.Error(wr, msg, http.StatusNotFound)
 		log.Println(logPrefix, http.StatusNotFound, msg)
 		return
 	}
 
+	// Packages are only served if they can be verified
+	expected, ok := t.Checksums[filePath]
+	if !ok || (expected.Size <= 0 && expected.Sha256 == "") {
+		msg := "No checksum for package: " + logPath
+		http.Error(wr, msg, http.StatusForbidden)
+		log.Println(logPrefix, http.StatusForbidden, "SECURITY:", msg)
+		return
+	}
+
 	client := &http.Client{Timeout: time.Duration(p.Cfg.TimeoutSeconds) * time.Second}
 
-	condaUrl := p.Cfg.CondaHost + req.URL.Path
+	// Package files are the same for all tenants
+	condaUrl := p.Cfg.CondaHost + path
 	log.Println("Fetching:", condaUrl)
 
 	resp, err := client.Get(condaUrl)
@@ -131,6 +238,11 @@ func (p *proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 
 	log.Println(logPrefix, resp.Status)
 
+	if resp.StatusCode == http.StatusOK {
+		p.copyVerified(wr, req, resp, logPrefix, filePath, expected)
+		return
+	}
+
 	copyHeader(wr.Header(), resp.Header)
 	wr.WriteHeader(resp.StatusCode)
 	if _, err := io.Copy(wr, resp.Body); err != nil {
@@ -139,6 +251,39 @@ func (p *proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// copyVerified streams an upstream package to the client, checking whichever of
+// its size and sha256 are in the filtered repodata
+//
+// If the package doesn't match the response is aborted before it's complete so
+// the client can't use it.
+func (p *proxy) copyVerified(wr http.ResponseWriter, req *http.Request, resp *http.Response, logPrefix string, filePath string, expected repodata.PackageChecksum) {
+	if expected.Size > 0 && resp.ContentLength >= 0 && resp.ContentLength != expected.Size {
+		http.Error(wr, "Bad Gateway", http.StatusBadGateway)
+		log.Println(logPrefix, http.StatusBadGateway, "SECURITY: upstream package doesn't match repodata:", filePath,
+			fmt.Sprintf("Content-Length %d != %d", resp.ContentLength, expected.Size))
+		return
+	}
+
+	copyHeader(wr.Header(), resp.Header)
+	if expected.Size > 0 {
+		wr.Header().Set("Content-Length", strconv.FormatInt(expected.Size, 10))
+	}
+	wr.WriteHeader(resp.StatusCode)
+	if req.Method == "HEAD" {
+		return
+	}
+
+	if _, err := repodata.CopyVerified(wr, resp.Body, expected); err != nil {
+		if errors.Is(err, repodata.ErrChecksumMismatch) {
+			log.Println(logPrefix, "SECURITY: upstream package doesn't match repodata:", filePath, err)
+		} else {
+			log.Println(logPrefix, "ERROR ServeHTTP:", err)
+		}
+		// The client has an incomplete response, make sure it's not treated as complete
+		panic(http.ErrAbortHandler)
+	}
+}
+
 func main() {
 	configFile := flag.String("cfg", "", "Configuration file")
 	flag.Parse()
@@ -152,9 +297,24 @@ func main() {
 		log.Fatalf("Failed to load configuration file: %s", err)
 	}
 
-	allowedFilelistName := filepath.Join(cfg.FilteredRepodataDir, "filenames.txt")
-	allowedFilenames := repodata.ParseListFromFile(allowedFilelistName)
-	log.Printf("Loaded %d allowed filenames from %s", allowedFilenames.Len(), allowedFilelistName)
+	p := &proxy{
+		Default: loadTenant("", cfg),
+		Tenants: make(map[string]*tenant),
+		Tokens:  make(map[string]*tenant),
+		Cfg:     cfg,
+	}
+	for _, name := range cfg.TenantNames() {
+		tenantCfg, err := cfg.Tenant(name)
+		if err != nil {
+			log.Fatalf("Invalid tenant: %s", err)
+		}
+		t := loadTenant(name, tenantCfg)
+		if token := cfg.Tenants[name].Token; token != "" {
+			p.Tokens[token] = t
+		} else {
+			p.Tenants[name] = t
+		}
+	}
 
 	// https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
 	srv := &http.Server{
@@ -162,10 +322,7 @@ func main() {
 		WriteTimeout: time.Duration(cfg.TimeoutSeconds) * time.Second,
 	}
 
-	srv.Handler = &proxy{
-		AllowedFilenames: allowedFilenames,
-		Cfg:              cfg,
-	}
+	srv.Handler = p
 	srv.Addr = cfg.Listen
 
 	log.Println("Starting conda-proxy server on", cfg.Listen)
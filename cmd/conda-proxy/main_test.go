@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/manics/go-conda-proxy/repodata"
+	"github.com/stretchr/testify/assert"
+)
+
+func testProxy(t *testing.T, upstream string, extraYaml string) (*proxy, string) {
+	tmpdir := t.TempDir()
+	cfgFile := filepath.Join(tmpdir, "config.yaml")
+	filtered := filepath.Join(tmpdir, "filtered")
+	cfgYaml := "filtered_repodata_dir: " + filtered + "\nchannels:\n  conda-forge:\n    subdirs: [noarch]\n"
+	if upstream != "" {
+		cfgYaml += "conda_host: " + upstream + "\n"
+	}
+	cfgYaml += extraYaml
+	if err := os.WriteFile(cfgFile, []byte(cfgYaml), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cfg, err := repodata.LoadCondaRepoConfig(cfgFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return &proxy{Default: &tenant{Cfg: cfg}, Tenants: map[string]*tenant{}, Tokens: map[string]*tenant{}, Cfg: cfg}, filtered
+}
+
+func TestServeJLAP(t *testing.T) {
+	p, filtered := testProxy(t, "", "")
+	jlapFile := repodata.GetDestinationFilename(filtered, "conda-forge", "noarch", ".jlap")
+	v1 := []byte(`{"info":{"subdir":"noarch"},"packages":{}}`)
+	v2 := []byte(`{"info":{"subdir":"noarch"},"packages":{"a-1-0.tar.bz2":{"name":"a"}}}`)
+	if err := repodata.UpdateJLAPFile(jlapFile, nil, v1, 30); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := repodata.UpdateJLAPFile(jlapFile, v1, v2, 30); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	jlap, err := os.ReadFile(jlapFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	req := httptest.NewRequest("GET", "/conda-forge/noarch/repodata.jlap", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, string(jlap), w.Body.String())
+
+	// A client that has the first version only downloads the new lines
+	offset := strings.Index(string(jlap), `{"url"`)
+	v3 := []byte(`{"info":{"subdir":"noarch"},"packages":{"b-1-0.tar.bz2":{"name":"b"}}}`)
+	if err := repodata.UpdateJLAPFile(jlapFile, v2, v3, 30); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	updated, err := os.ReadFile(jlapFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, string(jlap[:offset]), string(updated[:offset]))
+
+	req = httptest.NewRequest("GET", "/conda-forge/noarch/repodata.jlap", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, fmt.Sprintf("bytes %d-%d/%d", offset, len(updated)-1, len(updated)), w.Header().Get("Content-Range"))
+	assert.Equal(t, string(updated[offset:]), w.Body.String())
+
+	req = httptest.NewRequest("GET", "/conda-forge/linux-64/repodata.jlap", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServePackageVerified(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}))
+	defer upstream.Close()
+
+	p, _ := testProxy(t, upstream.URL, "")
+	// echo -n hello | sha256sum
+	helloSha256 := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	p.Default.AllowedFilenames = repodata.NewSet(nil)
+	p.Default.Checksums = map[string]repodata.PackageChecksum{
+		"conda-forge/noarch/valid-1-0.conda":    {Size: 5, Sha256: helloSha256},
+		"conda-forge/noarch/sha256-1-0.conda":   {Sha256: helloSha256},
+		"conda-forge/noarch/size-1-0.conda":     {Size: 6},
+		"conda-forge/noarch/mismatch-1-0.conda": {Sha256: strings.Repeat("0", 64)},
+		"conda-forge/noarch/empty-1-0.conda":    {},
+	}
+	for k := range p.Default.Checksums {
+		p.Default.AllowedFilenames.Add(k)
+	}
+	p.Default.AllowedFilenames.Add("conda-forge/noarch/missing-1-0.conda")
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	testCases := []struct {
+		name   string
+		status int
+		body   string
+		err    bool
+	}{
+		{"valid", http.StatusOK, "hello", false},
+		{"sha256", http.StatusOK, "hello", false},
+		{"size", http.StatusBadGateway, "Bad Gateway\n", false},
+		{"mismatch", 0, "", true},
+		{"empty", http.StatusForbidden, "No checksum for package: /conda-forge/noarch/empty-1-0.conda\n", false},
+		{"missing", http.StatusForbidden, "No checksum for package: /conda-forge/noarch/missing-1-0.conda\n", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + "/conda-forge/noarch/" + tc.name + "-1-0.conda")
+			if err == nil {
+				defer resp.Body.Close()
+				var body []byte
+				if body, err = io.ReadAll(resp.Body); err == nil {
+					assert.Equal(t, tc.status, resp.StatusCode)
+					assert.Equal(t, tc.body, string(body))
+				}
+			}
+			// The response is aborted, before or after the headers are sent
+			assert.Equal(t, tc.err, err != nil)
+		})
+	}
+}
+
+func TestSelectTenant(t *testing.T) {
+	tenantsYaml := `tenants:
+  team-a:
+    channels:
+      conda-forge: {}
+  team-b:
+    token: secret
+    channels:
+      conda-forge: {}
+  conda-forge:
+    channels:
+      conda-forge: {}
+`
+	p, _ := testProxy(t, "", tenantsYaml)
+	p.Default.AllowedFilenames = repodata.NewSet(nil)
+	// Tenants are registered in the same way as main
+	for _, name := range p.Cfg.TenantNames() {
+		tenantCfg, err := p.Cfg.Tenant(name)
+		if name == "conda-forge" {
+			// A tenant can't shadow a channel served by the default tenant
+			assert.EqualError(t, err, "tenant conda-forge has the same name as a channel")
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		tn := &tenant{Name: name, AllowedFilenames: repodata.NewSet(&[]string{"conda-forge/noarch/" + name + "-1-0.conda"}), Cfg: tenantCfg}
+		if token := p.Cfg.Tenants[name].Token; token != "" {
+			p.Tokens[token] = tn
+		} else {
+			p.Tenants[name] = tn
+		}
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	testCases := []struct {
+		name       string
+		path       string
+		tenant     string
+		tenantPath string
+		logPath    string
+		status     int
+		body       string
+	}{
+		{
+			"tenant", "/team-a/conda-forge/noarch/team-a-1-0.conda",
+			"team-a", "/conda-forge/noarch/team-a-1-0.conda", "/team-a/conda-forge/noarch/team-a-1-0.conda",
+			http.StatusForbidden, "No checksum for package: /team-a/conda-forge/noarch/team-a-1-0.conda\n",
+		},
+		{
+			"tenant-not-allowed", "/team-a/conda-forge/noarch/team-b-1-0.conda",
+			"team-a", "/conda-forge/noarch/team-b-1-0.conda", "/team-a/conda-forge/noarch/team-b-1-0.conda",
+			http.StatusNotFound, "Invalid filepath: /team-a/conda-forge/noarch/team-b-1-0.conda\n",
+		},
+		{
+			"token", "/t/secret/conda-forge/noarch/team-b-1-0.conda",
+			"team-b", "/conda-forge/noarch/team-b-1-0.conda", "/t/<token>/conda-forge/noarch/team-b-1-0.conda",
+			http.StatusForbidden, "No checksum for package: /t/<token>/conda-forge/noarch/team-b-1-0.conda\n",
+		},
+		{
+			"token-tenant-name", "/team-b/conda-forge/noarch/team-b-1-0.conda",
+			"", "/team-b/conda-forge/noarch/team-b-1-0.conda", "/team-b/conda-forge/noarch/team-b-1-0.conda",
+			http.StatusNotFound, "Invalid filepath: /team-b/conda-forge/noarch/team-b-1-0.conda\n",
+		},
+		{
+			"unknown-token", "/t/wrong/conda-forge/noarch/team-b-1-0.conda",
+			"<nil>", "", "/t/<token>/conda-forge/noarch/team-b-1-0.conda",
+			http.StatusNotFound, "Invalid token: /t/<token>/conda-forge/noarch/team-b-1-0.conda\n",
+		},
+		{
+			"channel", "/conda-forge/noarch/conda-forge-1-0.conda",
+			"", "/conda-forge/noarch/conda-forge-1-0.conda", "/conda-forge/noarch/conda-forge-1-0.conda",
+			http.StatusNotFound, "Invalid filepath: /conda-forge/noarch/conda-forge-1-0.conda\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tn, tenantPath, logPath := p.selectTenant(tc.path)
+			name := "<nil>"
+			if tn != nil {
+				name = tn.Name
+			}
+			assert.Equal(t, tc.tenant, name)
+			assert.Equal(t, tc.tenantPath, tenantPath)
+			assert.Equal(t, tc.logPath, logPath)
+
+			logs.Reset()
+			req := httptest.NewRequest("GET", tc.path, nil)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, tc.body, w.Body.String())
+			assert.Contains(t, logs.String(), tc.logPath)
+			// Tokens must never be logged
+			assert.NotContains(t, logs.String(), "secret")
+			assert.NotContains(t, logs.String(), "wrong")
+		})
+	}
+}
+
+func TestServePackageBlocked(t *testing.T) {
+	upstreamRequests := []string{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests = append(upstreamRequests, r.URL.Path)
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}))
+	defer upstream.Close()
+
+	p, _ := testProxy(t, upstream.URL, "")
+	// Blocked files take precedence over the allowlist and checksums
+	p.Default.AllowedFilenames = repodata.NewSet(&[]string{"conda-forge/noarch/a-1-0.conda", "conda-forge/noarch/a-2-0.conda"})
+	p.Default.Checksums = map[string]repodata.PackageChecksum{
+		"conda-forge/noarch/a-1-0.conda": {Size: 5},
+		"conda-forge/noarch/a-2-0.conda": {Size: 5},
+	}
+	p.Default.BlockedFilenames = map[string]string{
+		"conda-forge/noarch/a-1-0.conda": "GHSA-1234-5678-9abc",
+	}
+
+	req := httptest.NewRequest("GET", "/conda-forge/noarch/a-1-0.conda", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "Blocked by security advisory GHSA-1234-5678-9abc: /conda-forge/noarch/a-1-0.conda\n", w.Body.String())
+	assert.Empty(t, upstreamRequests)
+
+	req = httptest.NewRequest("GET", "/conda-forge/noarch/a-2-0.conda", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+	assert.Equal(t, []string{"/conda-forge/noarch/a-2-0.conda"}, upstreamRequests)
+}
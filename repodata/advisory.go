@@ -0,0 +1,239 @@
+// Vulnerability advisories in OSV format
+// https://ossf.github.io/osv-schema/
+package repodata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type osvEvent struct {
+	Introduced   string `json:"introduced,omitempty"`
+	Fixed        string `json:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty"`
+	Limit        string `json:"limit,omitempty"`
+}
+
+type osvRange struct {
+	Type   string     `json:"type"`
+	Events []osvEvent `json:"events"`
+}
+
+type osvAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+	Ranges   []osvRange `json:"ranges"`
+	Versions []string   `json:"versions"`
+}
+
+type osvAdvisory struct {
+	ID        string        `json:"id"`
+	Withdrawn string        `json:"withdrawn"`
+	Affected  []osvAffected `json:"affected"`
+}
+
+// advisoryEntry is the affected versions of a package from one advisory
+type advisoryEntry struct {
+	id       string
+	versions *Set
+	// Parsed and sorted events of each range
+	ranges [][]advisoryEvent
+}
+
+// advisoryEvent is an OSV range event with its parsed version, nil for "0"
+type advisoryEvent struct {
+	event   osvEvent
+	version *Version
+}
+
+// AdvisoryDatabase is a set of OSV advisories indexed by package name
+type AdvisoryDatabase struct {
+	entries map[string][]advisoryEntry
+}
+
+// ecosystemMatchesChannel returns true if an OSV ecosystem applies to a channel
+//
+// The ecosystem "conda" applies to all channels, "conda:<channel>" applies to one channel.
+func ecosystemMatchesChannel(ecosystem string, channel string) bool {
+	if strings.EqualFold(ecosystem, "conda") {
+		return true
+	}
+	prefix, name, found := strings.Cut(ecosystem, ":")
+	return found && strings.EqualFold(prefix, "conda") && name == channel
+}
+
+// LoadAdvisoryDatabase loads all OSV JSON advisories in a directory (recursively)
+// that apply to a channel
+func LoadAdvisoryDatabase(dir string, channel string) (*AdvisoryDatabase, error) {
+	db := &AdvisoryDatabase{entries: make(map[string][]advisoryEntry)}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var advisory osvAdvisory
+		// Fail closed, a broken advisory would otherwise silently allow affected packages
+		if err := json.Unmarshal(data, &advisory); err != nil {
+			return fmt.Errorf("invalid advisory %s: %s", path, err)
+		}
+		if err := db.add(&advisory, channel); err != nil {
+			return fmt.Errorf("invalid advisory %s: %s", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// add adds the affected packages of an advisory that apply to a channel
+//
+// Returns an error if a range event's version can't be parsed, or if an affected
+// package has no ECOSYSTEM or SEMVER range and no versions, since it would
+// never match anything.
+func (db *AdvisoryDatabase) add(advisory *osvAdvisory, channel string) error {
+	if advisory.Withdrawn != "" {
+		return nil
+	}
+	for _, affected := range advisory.Affected {
+		if !ecosystemMatchesChannel(affected.Package.Ecosystem, channel) {
+			continue
+		}
+		entry := advisoryEntry{
+			id:       advisory.ID,
+			versions: NewSet(&affected.Versions),
+		}
+		for _, r := range affected.Ranges {
+			if r.Type != "ECOSYSTEM" && r.Type != "SEMVER" {
+				continue
+			}
+			events, err := parseRange(r)
+			if err != nil {
+				return fmt.Errorf("%s %s: %s", advisory.ID, affected.Package.Name, err)
+			}
+			entry.ranges = append(entry.ranges, events)
+		}
+		if len(entry.ranges) == 0 && entry.versions.Len() == 0 {
+			return fmt.Errorf("%s %s: no ECOSYSTEM or SEMVER ranges or versions", advisory.ID, affected.Package.Name)
+		}
+		db.entries[affected.Package.Name] = append(db.entries[affected.Package.Name], entry)
+	}
+	return nil
+}
+
+// Len returns the number of packages with advisories
+func (db *AdvisoryDatabase) Len() int {
+	return len(db.entries)
+}
+
+// eventVersion returns the version of an event
+func eventVersion(e osvEvent) string {
+	for _, v := range []string{e.Introduced, e.Fixed, e.LastAffected, e.Limit} {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseRange parses the versions of the events in an OSV range, and sorts them
+//
+// Limit events aren't used for evaluation and are dropped.
+func parseRange(r osvRange) ([]advisoryEvent, error) {
+	events := []advisoryEvent{}
+	for _, e := range r.Events {
+		if e.Introduced == "0" {
+			events = append(events, advisoryEvent{e, nil})
+			continue
+		}
+		if e.Introduced == "" && e.Fixed == "" && e.LastAffected == "" {
+			if e.Limit == "" {
+				return nil, errors.New("empty range event")
+			}
+			continue
+		}
+		v, err := ParseVersion(eventVersion(e))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range version %s: %s", eventVersion(e), err)
+		}
+		events = append(events, advisoryEvent{e, v})
+	}
+	if len(events) == 0 {
+		return nil, errors.New("range has no events")
+	}
+	// "0" sorts before everything
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].version == nil || events[j].version == nil {
+			return events[i].version == nil && events[j].version != nil
+		}
+		return events[i].version.Compare(events[j].version) < 0
+	})
+	return events, nil
+}
+
+// versionInRange evaluates the sorted events of an OSV range
+// https://ossf.github.io/osv-schema/#evaluation
+func versionInRange(version *Version, events []advisoryEvent) bool {
+	affected := false
+	for _, e := range events {
+		switch {
+		case e.event.Introduced != "":
+			if e.version == nil || version.Compare(e.version) >= 0 {
+				affected = true
+			}
+		case e.event.Fixed != "":
+			if version.Compare(e.version) >= 0 {
+				affected = false
+			}
+		case e.event.LastAffected != "":
+			if version.Compare(e.version) > 0 {
+				affected = false
+			}
+		}
+	}
+	return affected
+}
+
+// Check returns the IDs of the advisories affecting a record
+func (db *AdvisoryDatabase) Check(record *RepodataRecord) []string {
+	entries, ok := db.entries[record.Name]
+	if !ok {
+		return nil
+	}
+	// Exact versions are still checked if the version can't be parsed
+	version, err := ParseVersion(record.Version)
+	if err != nil {
+		log.Printf("Only checking exact advisory versions for %s %s: %s", record.Name, record.Version, err)
+	}
+
+	ids := []string{}
+	for _, entry := range entries {
+		affected := entry.versions.Contains(record.Version)
+		for _, r := range entry.ranges {
+			if affected || version == nil {
+				break
+			}
+			affected = versionInRange(version, r)
+		}
+		if affected {
+			ids = append(ids, entry.id)
+		}
+	}
+	return ids
+}
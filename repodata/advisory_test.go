@@ -0,0 +1,179 @@
+package repodata
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEcosystemMatchesChannel(t *testing.T) {
+	assert.True(t, ecosystemMatchesChannel("conda", "conda-forge"))
+	assert.True(t, ecosystemMatchesChannel("Conda", "conda-forge"))
+	assert.True(t, ecosystemMatchesChannel("conda:conda-forge", "conda-forge"))
+	assert.False(t, ecosystemMatchesChannel("conda:bioconda", "conda-forge"))
+	assert.False(t, ecosystemMatchesChannel("PyPI", "conda-forge"))
+}
+
+func TestVersionInRange(t *testing.T) {
+	r := osvRange{
+		Type: "ECOSYSTEM",
+		Events: []osvEvent{
+			{Introduced: "2.0"},
+			{LastAffected: "2.1"},
+			{Introduced: "1.2"},
+			{Fixed: "1.2.4"},
+		},
+	}
+	testCases := []struct {
+		version  string
+		expected bool
+	}{
+		{"1.1", false},
+		{"1.2", true},
+		{"1.2.3", true},
+		{"1.2.4", false},
+		{"1.9", false},
+		{"2.0", true},
+		{"2.1", true},
+		{"2.1.1", false},
+	}
+	events, err := parseRange(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, tc := range testCases {
+		t.Run(tc.version, func(t *testing.T) {
+			assert.Equal(t, tc.expected, versionInRange(mustParseVersion(t, tc.version), events))
+		})
+	}
+
+	unbounded, err := parseRange(osvRange{Type: "ECOSYSTEM", Events: []osvEvent{{Introduced: "0"}, {Limit: "*"}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.True(t, versionInRange(mustParseVersion(t, "0.0.1"), unbounded))
+	assert.True(t, versionInRange(mustParseVersion(t, "99"), unbounded))
+}
+
+func TestParseRangeInvalid(t *testing.T) {
+	_, err := parseRange(osvRange{Type: "ECOSYSTEM", Events: []osvEvent{{Introduced: "1.0+a+b"}, {Fixed: "2"}}})
+	assert.ErrorContains(t, err, "invalid range version 1.0+a+b: ")
+
+	_, err = parseRange(osvRange{Type: "ECOSYSTEM", Events: []osvEvent{{Introduced: "0"}, {}}})
+	assert.EqualError(t, err, "empty range event")
+
+	_, err = parseRange(osvRange{Type: "ECOSYSTEM"})
+	assert.EqualError(t, err, "range has no events")
+}
+
+func TestLoadAdvisoryDatabase(t *testing.T) {
+	db, err := LoadAdvisoryDatabase("testdata/advisories", "testdata")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// a is only in a withdrawn advisory, PyPI c is ignored
+	assert.Equal(t, 2, db.Len())
+
+	testCases := []struct {
+		name     string
+		version  string
+		expected []string
+	}{
+		{"a", "1", nil},
+		{"b", "1.1", []string{"CONDA-2023-0001"}},
+		{"b", "1.2", []string{}},
+		{"c", "0.9", []string{"CONDA-2023-0002"}},
+		{"c", "1.2.3", []string{"CONDA-2023-0002"}},
+		{"c", "1.3", []string{}},
+		{"d", "1", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name+"-"+tc.version, func(t *testing.T) {
+			assert.Equal(t, tc.expected, db.Check(&RepodataRecord{Name: tc.name, Version: tc.version}))
+		})
+	}
+
+	// Advisory for the "conda:testdata" ecosystem doesn't apply to other channels
+	other, err := LoadAdvisoryDatabase("testdata/advisories", "conda-forge")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, 1, other.Len())
+	assert.Nil(t, other.Check(&RepodataRecord{Name: "c", Version: "0.9"}))
+}
+
+func TestLoadAdvisoryDatabaseInvalid(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bad.json"), []byte(`{"id": "CONDA-2023-0004",`), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err := LoadAdvisoryDatabase(dir, "conda-forge")
+	assert.ErrorContains(t, err, "invalid advisory "+filepath.Join(dir, "bad.json")+": ")
+}
+
+func TestLoadAdvisoryDatabaseUnusable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		affected string
+		err      string
+	}{
+		{
+			"invalid introduced",
+			`{"package": {"ecosystem": "conda", "name": "e"}, "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "1.0+a+b"}, {"fixed": "2"}]}]}`,
+			"CONDA-2023-0006 e: invalid range version 1.0+a+b: ",
+		},
+		{
+			"invalid fixed",
+			`{"package": {"ecosystem": "conda", "name": "e"}, "ranges": [{"type": "SEMVER", "events": [{"introduced": "0"}, {"fixed": "2+x+y"}]}], "versions": ["1"]}`,
+			"CONDA-2023-0006 e: invalid range version 2+x+y: ",
+		},
+		{
+			"git only",
+			`{"package": {"ecosystem": "conda", "name": "e"}, "ranges": [{"type": "GIT", "repo": "https://example.org/e", "events": [{"introduced": "0"}, {"fixed": "abcdef"}]}]}`,
+			"CONDA-2023-0006 e: no ECOSYSTEM or SEMVER ranges or versions",
+		},
+		{
+			"nothing affected",
+			`{"package": {"ecosystem": "conda", "name": "e"}}`,
+			"CONDA-2023-0006 e: no ECOSYSTEM or SEMVER ranges or versions",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "CONDA-2023-0006.json")
+			if err := os.WriteFile(filename, []byte(`{"id": "CONDA-2023-0006", "affected": [`+tc.affected+`]}`), 0644); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			_, err := LoadAdvisoryDatabase(dir, "conda-forge")
+			assert.ErrorContains(t, err, "invalid advisory "+filename+": "+tc.err)
+
+			// Advisories for other ecosystems aren't checked
+			other := strings.Replace(tc.affected, `"conda"`, `"PyPI"`, 1)
+			if err := os.WriteFile(filename, []byte(`{"id": "CONDA-2023-0006", "affected": [`+other+`]}`), 0644); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			_, err = LoadAdvisoryDatabase(dir, "conda-forge")
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAdvisoryDatabaseCheckUnparsableVersion(t *testing.T) {
+	affected := osvAffected{
+		Ranges:   []osvRange{{Type: "ECOSYSTEM", Events: []osvEvent{{Introduced: "0"}, {Fixed: "2"}}}},
+		Versions: []string{"1.0+a+b"},
+	}
+	affected.Package.Ecosystem = "conda"
+	affected.Package.Name = "e"
+	db := &AdvisoryDatabase{entries: make(map[string][]advisoryEntry)}
+	assert.NoError(t, db.add(&osvAdvisory{ID: "CONDA-2023-0005", Affected: []osvAffected{affected}}, "conda-forge"))
+
+	// The exact version is matched even though the ranges can't be evaluated
+	assert.Equal(t, []string{"CONDA-2023-0005"}, db.Check(&RepodataRecord{Name: "e", Version: "1.0+a+b"}))
+	assert.Equal(t, []string{}, db.Check(&RepodataRecord{Name: "e", Version: "1.1+a+b"}))
+	assert.Equal(t, []string{"CONDA-2023-0005"}, db.Check(&RepodataRecord{Name: "e", Version: "1.1"}))
+}
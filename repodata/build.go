@@ -0,0 +1,93 @@
+// Build string and track_features filters
+package repodata
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// BuildPolicy excludes records based on their build string or track_features,
+// e.g. to drop CUDA builds
+type BuildPolicy struct {
+	// Build string globs, matching records are excluded
+	exclude []string
+	// Records of packages named in include must match one of its MatchSpecs,
+	// e.g. "pytorch * *cpu*"
+	include *PackageList
+	// track_features globs, records with a matching feature are excluded
+	excludeTrackFeatures []string
+}
+
+// validateGlobs checks that all patterns are valid globs
+func validateGlobs(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("invalid pattern: " + pattern)
+		}
+	}
+	return nil
+}
+
+// matchingGlob returns the first pattern that matches s, or an empty string
+func matchingGlob(patterns []string, s string) string {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, s); matched {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// NewBuildPolicy creates a build policy
+//
+// exclude and excludeTrackFeatures are globs. include is a list of MatchSpecs
+// with build strings, packages that aren't named in include aren't affected by it.
+func NewBuildPolicy(exclude []string, include []string, excludeTrackFeatures []string) (*BuildPolicy, error) {
+	if err := validateGlobs(exclude); err != nil {
+		return nil, err
+	}
+	if err := validateGlobs(excludeTrackFeatures); err != nil {
+		return nil, err
+	}
+	p := &BuildPolicy{
+		exclude:              exclude,
+		include:              NewPackageList(),
+		excludeTrackFeatures: excludeTrackFeatures,
+	}
+	for _, spec := range include {
+		if err := p.include.AddSpec(spec); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// trackFeatures returns the track_features of a record, which may be separated
+// by spaces or commas
+func trackFeatures(record *RepodataRecord) []string {
+	features, _ := record.Extra["track_features"].(string)
+	return strings.FieldsFunc(features, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+}
+
+// Check returns true if the record is allowed, and a reason if it isn't
+func (p *BuildPolicy) Check(record *RepodataRecord) (bool, string) {
+	if pattern := matchingGlob(p.exclude, record.Build); pattern != "" {
+		return false, "build string " + record.Build + " matches " + pattern
+	}
+	if specs := p.include.Specs(record.Name); len(specs) > 0 && p.include.MatchingSpec(record) == nil {
+		names := []string{}
+		for _, spec := range specs {
+			names = append(names, spec.String())
+		}
+		return false, "build string " + record.Build + " doesn't match " + strings.Join(names, " | ")
+	}
+	for _, feature := range trackFeatures(record) {
+		if pattern := matchingGlob(p.excludeTrackFeatures, feature); pattern != "" {
+			return false, "track_features " + feature + " matches " + pattern
+		}
+	}
+	return true, ""
+}
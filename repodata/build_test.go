@@ -0,0 +1,58 @@
+package repodata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBuildPolicyInvalid(t *testing.T) {
+	_, err := NewBuildPolicy([]string{"[cuda"}, nil, nil)
+	assert.EqualError(t, err, "invalid pattern: [cuda")
+	_, err = NewBuildPolicy(nil, nil, []string{"[cuda"})
+	assert.EqualError(t, err, "invalid pattern: [cuda")
+	_, err = NewBuildPolicy(nil, []string{"pytorch >=="}, nil)
+	assert.Error(t, err)
+}
+
+func TestBuildPolicyCheck(t *testing.T) {
+	policy, err := NewBuildPolicy(
+		[]string{"*cuda*", "*_pypy*"},
+		[]string{"pytorch * *cpu*", "tensorflow-* * cpu_*"},
+		[]string{"*cuda*", "blas_openblas"},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		name     string
+		build    string
+		features string
+		allowed  bool
+		reason   string
+	}{
+		{"numpy", "py311h64a7726_0", "", true, ""},
+		{"numpy", "py39_pypy38_0", "", false, "build string py39_pypy38_0 matches *_pypy*"},
+		{"cupy", "py311cuda120h_0", "", false, "build string py311cuda120h_0 matches *cuda*"},
+		{"pytorch", "cpu_py311h_0", "", true, ""},
+		{"pytorch", "cuda120_py311h_0", "", false, "build string cuda120_py311h_0 matches *cuda*"},
+		{"pytorch", "py311h_0", "", false, "build string py311h_0 doesn't match pytorch * *cpu*"},
+		{"tensorflow-base", "gpu_py311h_0", "", false, "build string gpu_py311h_0 doesn't match tensorflow-* * cpu_*"},
+		{"libblas", "19_linux64_mkl", "blas_mkl", true, ""},
+		{"libblas", "19_linux64_openblas", "blas_openblas", false, "track_features blas_openblas matches blas_openblas"},
+		{"libfoo", "0", "foo, cuda_12", false, "track_features cuda_12 matches *cuda*"},
+		{"libfoo", "0", "foo bar", true, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name+"-"+tc.build, func(t *testing.T) {
+			record := &RepodataRecord{Name: tc.name, Version: "1.0", Build: tc.build}
+			if tc.features != "" {
+				record.Extra = map[string]interface{}{"track_features": tc.features}
+			}
+			allowed, reason := policy.Check(record)
+			assert.Equal(t, tc.allowed, allowed)
+			assert.Equal(t, tc.reason, reason)
+		})
+	}
+}
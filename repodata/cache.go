@@ -1,13 +1,20 @@
 package repodata
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/DataDog/zstd"
 )
 
 // WriteTempAndRename writes src to a tempfile, and then rename tempfile to destination
@@ -31,31 +38,301 @@ func WriteTempAndRename(src io.Reader, destination string) error {
 	return err
 }
 
+// CacheMetadata holds the upstream HTTP caching headers of a downloaded file
+type CacheMetadata struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Compression of the downloaded file, e.g. "zstd", the cached file is always decompressed
+	Compression string `json:"compression,omitempty"`
+	// BLAKE2b-256 hash of the upstream version of the file. After jlap patches
+	// are applied this is the hash of the patched upstream version, not the
+	// cached file.
+	Blake2b string `json:"blake2b,omitempty"`
+	// Position of the metadata line in the upstream repodata.jlap, and the
+	// checksum of the line before it, the next update only downloads the
+	// lines after this
+	JLAPOffset   int64  `json:"jlap_offset,omitempty"`
+	JLAPChecksum string `json:"jlap_checksum,omitempty"`
+	JLAPETag     string `json:"jlap_etag,omitempty"`
+}
+
+// cacheMetadataFilename returns the filename of the metadata for a downloaded file
+func cacheMetadataFilename(destination string) string {
+	return destination + ".cache.json"
+}
+
+// LoadCacheMetadata loads the metadata for a downloaded file
+func LoadCacheMetadata(destination string) (*CacheMetadata, error) {
+	data, err := os.ReadFile(cacheMetadataFilename(destination))
+	if err != nil {
+		return nil, err
+	}
+	var m CacheMetadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// saveCacheMetadata saves the metadata for a downloaded file
+func saveCacheMetadata(destination string, m *CacheMetadata) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteTempAndRename(bytes.NewReader(data), cacheMetadataFilename(destination))
+}
+
 // UpdateDownload downloads a URL if it is older than maxAgeMinutes
 //
-// Set maxAgeMinutes to 0 to force an update
-func UpdateDownload(url string, destination string, maxAgeMinutes int) error {
+// Set maxAgeMinutes to 0 to always check for an update. If the upstream ETag or
+// Last-Modified header of the cached file is known a conditional request is
+// made, and if the file hasn't changed only its modification time is updated.
+// Set force to download the file unconditionally, e.g. to replace a corrupted
+// cached file.
+func UpdateDownload(url string, destination string, maxAgeMinutes int, force bool) error {
+	if !force && isCached(destination, maxAgeMinutes) {
+		return nil
+	}
+	return updateDownload([]string{url}, destination, force)
+}
+
+// UpdateRepodataDownload downloads a repodata.json URL if it is older than
+// maxAgeMinutes, as UpdateDownload
+//
+// If the cached file is from a known upstream version it's updated with the
+// patches in repodata.jlap. Otherwise, or if force is set, repodata.json.zst is
+// tried first and decompressed, repodata.json is used if it's missing.
+func UpdateRepodataDownload(url string, destination string, maxAgeMinutes int, force bool) error {
+	if !force {
+		if isCached(destination, maxAgeMinutes) {
+			return nil
+		}
+		err := updateFromJLAP(strings.TrimSuffix(url, ".json")+".jlap", destination)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Not updating %s from jlap: %s\n", destination, err)
+	}
+	return updateDownload([]string{url + ".zst", url}, destination, force)
+}
+
+// isCached returns true if destination is newer than maxAgeMinutes
+func isCached(destination string, maxAgeMinutes int) bool {
 	if info, err := os.Stat(destination); err == nil {
 		ageInMinutes := int(time.Since(info.ModTime()).Minutes())
 		if maxAgeMinutes > 0 && ageInMinutes < maxAgeMinutes {
 			log.Printf("Using cached %s (%d minutes old)\n", destination, ageInMinutes)
-			return nil
+			return true
 		}
 	}
+	return false
+}
+
+// updateFromJLAP updates a cached repodata.json with the patches in a jlap file
+//
+// Returns an error if the cached file can't be updated, e.g. if the jlap file
+// doesn't exist, is invalid, or doesn't have a patch from the cached version.
+func updateFromJLAP(url string, destination string) error {
+	previous, err := LoadCacheMetadata(destination)
+	if err != nil {
+		return err
+	}
+	if previous.Blake2b == "" {
+		return errors.New("unknown upstream version")
+	}
 
 	log.Printf("Updating %s from %s\n", destination, url)
+	jlap, tail, err := downloadJLAP(url, previous)
+	if err != nil {
+		return err
+	}
+	if jlap == nil {
+		log.Printf("Not modified %s\n", url)
+		now := time.Now()
+		return os.Chtimes(destination, now, now)
+	}
+	patches, err := jlap.PatchesFrom(previous.Blake2b)
+	if err != nil {
+		return err
+	}
+	// The HTTP caching headers are for the previous version
+	next := &CacheMetadata{
+		URL:          previous.URL,
+		Compression:  previous.Compression,
+		Blake2b:      jlap.Metadata.Latest,
+		JLAPOffset:   tail.Offset,
+		JLAPChecksum: tail.Checksum,
+		JLAPETag:     tail.ETag,
+	}
+	if len(patches) == 0 {
+		log.Printf("Not modified %s\n", url)
+		now := time.Now()
+		if err := os.Chtimes(destination, now, now); err != nil {
+			return err
+		}
+		return saveCacheMetadata(destination, next)
+	}
 
-	resp, err := http.Get(url)
+	cached, err := os.ReadFile(destination)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status + " " + url)
+	updated, err := ApplyJLAPPatches(cached, patches)
+	if err != nil {
+		return err
+	}
+	if err := WriteTempAndRename(bytes.NewReader(updated), destination); err != nil {
+		return err
+	}
+	log.Printf("Applied %d patches to %s\n", len(patches), destination)
+	return saveCacheMetadata(destination, next)
+}
+
+// jlapDownload is the position of the end of the patches in a downloaded jlap
+// file, and its ETag
+type jlapDownload struct {
+	jlapTail
+	ETag string
+}
+
+// downloadJLAP downloads and verifies a jlap file
+//
+// If the end of the patches in the previously downloaded jlap file is known
+// only the lines after it are requested, and verified starting from the
+// checksum of the last known patch. If the upstream file has been rewritten,
+// e.g. trimmed, all of it is downloaded. Returns a nil JLAP if the file hasn't
+// changed.
+func downloadJLAP(url string, previous *CacheMetadata) (*JLAP, *jlapDownload, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	offset := previous.JLAPOffset
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if previous.JLAPETag != "" {
+			req.Header.Set("If-None-Match", previous.JLAPETag)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
-	err = WriteTempAndRename(resp.Body, destination)
-	return err
+	downloadAll := func(reason string) (*JLAP, *jlapDownload, error) {
+		log.Printf("Downloading all of %s: %s\n", url, reason)
+		return downloadJLAP(url, &CacheMetadata{})
+	}
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if offset > 0 {
+			return nil, nil, nil
+		}
+	case http.StatusPartialContent:
+		if offset > 0 {
+			if contentRange := resp.Header.Get("Content-Range"); !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", offset)) {
+				return downloadAll("unexpected Content-Range " + contentRange)
+			}
+		}
+	case http.StatusOK:
+		// Range isn't supported
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset > 0 {
+			return downloadAll(resp.Status)
+		}
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, nil, errors.New(resp.Status + " " + url)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset > 0 {
+		data = append([]byte(previous.JLAPChecksum+"\n"), data...)
+	}
+	j, tail, err := parseJLAP(data)
+	if err != nil {
+		if offset > 0 {
+			return downloadAll(err.Error())
+		}
+		return nil, nil, err
+	}
+	if offset > 0 {
+		tail.Offset += offset - int64(len(previous.JLAPChecksum)+1)
+	}
+	return j, &jlapDownload{jlapTail: *tail, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// updateDownload downloads the first URL that exists, URLs ending in .zst are
+// decompressed. Conditional requests are only made if force isn't set.
+func updateDownload(urls []string, destination string, force bool) error {
+	var previous *CacheMetadata = nil
+	if _, err := os.Stat(destination); err == nil && !force {
+		previous, _ = LoadCacheMetadata(destination)
+	}
+
+	for i, url := range urls {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		if previous != nil && previous.URL == url {
+			if previous.ETag != "" {
+				req.Header.Set("If-None-Match", previous.ETag)
+			}
+			if previous.LastModified != "" {
+				req.Header.Set("If-Modified-Since", previous.LastModified)
+			}
+		}
+
+		log.Printf("Updating %s from %s\n", destination, url)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound && i < len(urls)-1 {
+			log.Printf("Not found %s, trying %s\n", url, urls[i+1])
+			continue
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			log.Printf("Not modified %s\n", url)
+			now := time.Now()
+			return os.Chtimes(destination, now, now)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(resp.Status + " " + url)
+		}
+
+		var body io.Reader = resp.Body
+		compression := ""
+		if strings.HasSuffix(url, ".zst") {
+			decompressed := zstd.NewReader(resp.Body)
+			defer decompressed.Close()
+			body = decompressed
+			compression = "zstd"
+		}
+		hash := NewBlake2b256()
+		if err := WriteTempAndRename(io.TeeReader(body, hash), destination); err != nil {
+			return err
+		}
+		return saveCacheMetadata(destination, &CacheMetadata{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Compression:  compression,
+			Blake2b:      hex.EncodeToString(hash.Sum(nil)),
+		})
+	}
+	return errors.New("no URLs to download")
 }
 
 func GetDestinationFilename(parentdir string, channel string, subdir string, suffix string) string {
@@ -65,12 +342,12 @@ func GetDestinationFilename(parentdir string, channel string, subdir string, suf
 	return filepath.Join(parentdir, channel, subdir, "repodata"+suffix)
 }
 
-func UpdateChannelRepodata(host string, parentdir string, channel string, subdirs []string, maxAgeMinutes int) error {
+func UpdateChannelRepodata(host string, parentdir string, channel string, subdirs []string, maxAgeMinutes int, force bool) error {
 	errs := []error{}
 	for _, subdir := range subdirs {
 		destination := GetDestinationFilename(parentdir, channel, subdir, ".json")
 		url := host + "/" + channel + "/" + subdir + "/repodata.json"
-		if err := UpdateDownload(url, destination, maxAgeMinutes); err != nil {
+		if err := UpdateRepodataDownload(url, destination, maxAgeMinutes, force); err != nil {
 			errs = append(errs, err)
 			log.Printf("Error updating %s: %s\n", destination, err)
 		}
@@ -86,7 +363,7 @@ func UpdateFromConfig(cfg *CondaRepoConfig, forceUpdate bool) error {
 		maxAgeMinutes = 0
 	}
 	for channel, channelConfig := range cfg.Channels {
-		err := UpdateChannelRepodata(cfg.CondaHost, cfg.OriginalRepodataDir, channel, channelConfig.Subdirs, maxAgeMinutes)
+		err := UpdateChannelRepodata(cfg.CondaHost, cfg.OriginalRepodataDir, channel, channelConfig.Subdirs, maxAgeMinutes, forceUpdate)
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -7,8 +7,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/DataDog/zstd"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,6 +29,18 @@ func mockServer(t *testing.T, failOnError bool) *httptest.Server {
 			if _, err := w.Write([]byte(`{"info":{"subdir":"noarch"}}`)); err != nil {
 				t.Fatalf("Unexpected error: %s", err)
 			}
+		} else if r.URL.Path == "/channel-zst/noarch/repodata.json.zst" {
+			w.WriteHeader(http.StatusOK)
+			compressed, err := zstd.Compress(nil, []byte(`{"info":{"subdir":"noarch"},"compressed":true}`))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if _, err := w.Write(compressed); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+		} else if strings.HasSuffix(r.URL.Path, ".zst") || strings.HasSuffix(r.URL.Path, ".jlap") {
+			// Channels don't have to provide compressed or incremental repodata
+			w.WriteHeader(http.StatusNotFound)
 		} else if r.URL.Path == "/count" {
 			w.WriteHeader(http.StatusOK)
 			if _, err := w.Write([]byte(fmt.Sprint(count))); err != nil {
@@ -73,7 +88,7 @@ func TestUpdateDownload(t *testing.T) {
 	// Make two requests with a 0 maxAgeMinutes (should result in updated file),
 	// and one with a 1440 maxAgeMinutes (should result in cached file)
 
-	if err := UpdateDownload(url, destination, 0); err != nil {
+	if err := UpdateDownload(url, destination, 0, false); err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
 
@@ -83,7 +98,7 @@ func TestUpdateDownload(t *testing.T) {
 		assert.Equal(t, "1", string(contents))
 	}
 
-	if err := UpdateDownload(url, destination, 0); err != nil {
+	if err := UpdateDownload(url, destination, 0, false); err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
 
@@ -93,7 +108,7 @@ func TestUpdateDownload(t *testing.T) {
 		assert.Equal(t, "2", string(contents))
 	}
 
-	if err := UpdateDownload(url, destination, 1440); err != nil {
+	if err := UpdateDownload(url, destination, 1440, false); err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
 
@@ -126,7 +141,7 @@ func TestUpdateChannelRepodata(t *testing.T) {
 	defer server.Close()
 
 	tmpdir := t.TempDir()
-	if err := UpdateChannelRepodata(server.URL, tmpdir, "channel-test", []string{"win-arm64", "noarch"}, 0); err != nil {
+	if err := UpdateChannelRepodata(server.URL, tmpdir, "channel-test", []string{"win-arm64", "noarch"}, 0, false); err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
 
@@ -136,7 +151,38 @@ func TestUpdateChannelRepodata(t *testing.T) {
 		} else {
 			assert.Equal(t, `{"info":{"subdir":"`+subdir+`"}}`, string(content))
 		}
+		m, err := LoadCacheMetadata(filepath.Join(tmpdir, "channel-test", subdir, "repodata.json"))
+		assert.NoError(t, err)
+		assert.Equal(t, &CacheMetadata{
+			URL:     server.URL + "/channel-test/" + subdir + "/repodata.json",
+			Blake2b: Blake2b256([]byte(`{"info":{"subdir":"` + subdir + `"}}`)),
+		}, m)
+	}
+}
+
+func TestUpdateChannelRepodataZst(t *testing.T) {
+	server := mockServer(t, true)
+	defer server.Close()
+
+	tmpdir := t.TempDir()
+	if err := UpdateChannelRepodata(server.URL, tmpdir, "channel-zst", []string{"noarch"}, 0, false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	destination := filepath.Join(tmpdir, "channel-zst", "noarch", "repodata.json")
+	content, err := os.ReadFile(destination)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
 	}
+	assert.Equal(t, `{"info":{"subdir":"noarch"},"compressed":true}`, string(content))
+
+	m, err := LoadCacheMetadata(destination)
+	assert.NoError(t, err)
+	assert.Equal(t, &CacheMetadata{
+		URL:         server.URL + "/channel-zst/noarch/repodata.json.zst",
+		Compression: "zstd",
+		Blake2b:     Blake2b256([]byte(`{"info":{"subdir":"noarch"},"compressed":true}`)),
+	}, m)
 }
 
 func TestUpdateFromConfig(t *testing.T) {
@@ -174,3 +220,84 @@ func TestUpdateFromConfig(t *testing.T) {
 		assert.NoFileExists(t, filepath.Join(tmpdir, "original", "nonexistent", subdir, "repodata.json"))
 	}
 }
+
+func TestUpdateDownloadConditional(t *testing.T) {
+	lastModified := "Wed, 02 Aug 2023 10:00:00 GMT"
+	requests := []http.Header{}
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Clone())
+		if r.URL.Path == "/etag" {
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+		}
+		if r.URL.Path == "/last-modified" {
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Last-Modified", lastModified)
+		}
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(fmt.Sprint(len(requests)))); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	tmpdir := t.TempDir()
+	destination := filepath.Join(tmpdir, "etag")
+	old := time.Now().Add(-48 * time.Hour)
+
+	assert.NoError(t, UpdateDownload(server.URL+"/etag", destination, 0, false))
+	assert.Equal(t, "", requests[0].Get("If-None-Match"))
+	m, err := LoadCacheMetadata(destination)
+	assert.NoError(t, err)
+	assert.Equal(t, &CacheMetadata{URL: server.URL + "/etag", ETag: etag, Blake2b: Blake2b256([]byte("1"))}, m)
+
+	// Not modified, only the modification time is updated
+	assert.NoError(t, os.Chtimes(destination, old, old))
+	assert.NoError(t, UpdateDownload(server.URL+"/etag", destination, 60, false))
+	assert.Equal(t, etag, requests[1].Get("If-None-Match"))
+	contents, _ := os.ReadFile(destination)
+	assert.Equal(t, "1", string(contents))
+	info, _ := os.Stat(destination)
+	assert.WithinDuration(t, time.Now(), info.ModTime(), time.Minute)
+
+	// Modified
+	etag = `"v2"`
+	assert.NoError(t, UpdateDownload(server.URL+"/etag", destination, 0, false))
+	contents, _ = os.ReadFile(destination)
+	assert.Equal(t, "3", string(contents))
+	m, _ = LoadCacheMetadata(destination)
+	assert.Equal(t, `"v2"`, m.ETag)
+
+	// The metadata is ignored if the URL changes
+	assert.NoError(t, UpdateDownload(server.URL+"/last-modified", destination, 0, false))
+	assert.Equal(t, "", requests[3].Get("If-None-Match"))
+	m, _ = LoadCacheMetadata(destination)
+	assert.Equal(t, &CacheMetadata{URL: server.URL + "/last-modified", LastModified: lastModified, Blake2b: Blake2b256([]byte("4"))}, m)
+
+	assert.NoError(t, UpdateDownload(server.URL+"/last-modified", destination, 0, false))
+	assert.Equal(t, lastModified, requests[4].Get("If-Modified-Since"))
+	contents, _ = os.ReadFile(destination)
+	assert.Equal(t, "4", string(contents))
+
+	// The metadata is ignored if the file is missing
+	assert.NoError(t, os.Remove(destination))
+	assert.NoError(t, UpdateDownload(server.URL+"/last-modified", destination, 0, false))
+	assert.Equal(t, "", requests[5].Get("If-Modified-Since"))
+	contents, _ = os.ReadFile(destination)
+	assert.Equal(t, "6", string(contents))
+
+	// Forced, the file is downloaded unconditionally even if it's corrupted
+	assert.NoError(t, os.WriteFile(destination, []byte("corrupted"), 0644))
+	assert.NoError(t, UpdateDownload(server.URL+"/last-modified", destination, 1440, true))
+	assert.Equal(t, "", requests[6].Get("If-Modified-Since"))
+	assert.Equal(t, "", requests[6].Get("If-None-Match"))
+	contents, _ = os.ReadFile(destination)
+	assert.Equal(t, "7", string(contents))
+}
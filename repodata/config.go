@@ -1,15 +1,66 @@
 package repodata
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"golang.org/x/exp/slices"
 	"gopkg.in/yaml.v3"
 )
 
+type licensePolicyConfig struct {
+	Allow            []string `yaml:"allow"`
+	AllowOsiApproved bool     `yaml:"allow_osi_approved"`
+	Deny             []string `yaml:"deny"`
+	Fallback         string   `yaml:"fallback"`
+}
+
+type buildPolicyConfig struct {
+	Exclude              []string `yaml:"exclude"`
+	Include              []string `yaml:"include"`
+	ExcludeTrackFeatures []string `yaml:"exclude_track_features"`
+}
+
+type retentionConfig struct {
+	KeepVersions int `yaml:"keep_versions"`
+	KeepMonths   int `yaml:"keep_months"`
+	KeepBuilds   int `yaml:"keep_builds"`
+}
+
 type condaChannelConfig struct {
 	Subdirs             []string `yaml:"subdirs"`
 	AllowlistFile       string   `yaml:"allowlist_file"`
+	EnvironmentFiles    []string `yaml:"environment_files"`
+	Lockfiles           []string `yaml:"lockfiles"`
+	DenylistFile        string   `yaml:"denylist_file"`
 	RecurseDependencies bool     `yaml:"recurse_dependencies"`
+	IncludeConstrains   bool     `yaml:"include_constrains"`
+	MinAgeDays          int      `yaml:"min_age_days"`
+	MinAgeExempt        []string `yaml:"min_age_exempt"`
+	PreferConda         bool     `yaml:"prefer_conda"`
+	MaxPackageSizeMB    int      `yaml:"max_package_size_mb"`
+	// Maps a package name to its own maximum size, 0 for no limit
+	MaxPackageSizeOverrides map[string]int `yaml:"max_package_size_overrides"`
+
+	LicensePolicy *licensePolicyConfig `yaml:"license_policy"`
+	BuildPolicy   *buildPolicyConfig   `yaml:"build_policy"`
+	// Maps a subdir to the versions of the virtual packages available on the target platform
+	VirtualPackages map[string]map[string]string `yaml:"virtual_packages"`
+	Retention       *retentionConfig             `yaml:"retention"`
+	// Maps a subdir to a patch_instructions.json file
+	PatchInstructions map[string]string `yaml:"patch_instructions"`
+}
+
+type tenantConfig struct {
+	// If set the tenant is only served under /t/<token>/ instead of /<name>/
+	Token string `yaml:"token"`
+	// Filtering options for a subset of the top-level channels, subdirs default
+	// to the top-level channel's subdirs
+	Channels map[string]condaChannelConfig `yaml:"channels"`
 }
 
 type CondaRepoConfig struct {
@@ -20,7 +71,9 @@ type CondaRepoConfig struct {
 	CacheControlMaxAgeMinutes int                           `yaml:"cache_control_max_age_minutes"`
 	OriginalRepodataDir       string                        `yaml:"original_repodata_dir"`
 	FilteredRepodataDir       string                        `yaml:"filtered_repodata_dir"`
+	AdvisoriesDir             string                        `yaml:"advisories_dir"`
 	Channels                  map[string]condaChannelConfig `yaml:"channels"`
+	Tenants                   map[string]tenantConfig       `yaml:"tenants"`
 }
 
 // LoadCondaRepoConfig loads a configuration file and returns the config
@@ -50,3 +103,51 @@ func (c *CondaRepoConfig) Load(filename string) error {
 	err = yaml.Unmarshal(data, c)
 	return err
 }
+
+// TenantNames returns the sorted names of the tenants
+func (c *CondaRepoConfig) TenantNames() []string {
+	names := []string{}
+	for name := range c.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Tenant returns the configuration of a tenant
+//
+// The tenant shares the upstream repodata and all other settings, but has its
+// own channel filters and filtered repodata directory.
+func (c *CondaRepoConfig) Tenant(name string) (*CondaRepoConfig, error) {
+	tenant, ok := c.Tenants[name]
+	if !ok {
+		return nil, errors.New("unknown tenant: " + name)
+	}
+	if name == "" || name == "t" || name == "tenants" || strings.Contains(name, "/") {
+		return nil, errors.New("invalid tenant name: " + name)
+	}
+	if _, ok := c.Channels[name]; ok {
+		return nil, fmt.Errorf("tenant %s has the same name as a channel", name)
+	}
+
+	t := *c
+	t.FilteredRepodataDir = filepath.Join(c.FilteredRepodataDir, "tenants", name)
+	t.Channels = make(map[string]condaChannelConfig)
+	t.Tenants = nil
+	for channel, channelCfg := range tenant.Channels {
+		upstream, ok := c.Channels[channel]
+		if !ok {
+			return nil, fmt.Errorf("tenant %s: channel %s isn't in channels", name, channel)
+		}
+		if len(channelCfg.Subdirs) == 0 {
+			channelCfg.Subdirs = upstream.Subdirs
+		}
+		for _, subdir := range channelCfg.Subdirs {
+			if !slices.Contains(upstream.Subdirs, subdir) {
+				return nil, fmt.Errorf("tenant %s: subdir %s/%s isn't in channels", name, channel, subdir)
+			}
+		}
+		t.Channels[channel] = channelCfg
+	}
+	return &t, nil
+}
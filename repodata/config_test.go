@@ -13,12 +13,46 @@ func TestConfigLoad(t *testing.T) {
 timeout_seconds: 123
 listen: localhost:54321
 filtered_repodata_dir: repodata-cache/filtered-x
+advisories_dir: /test/advisories
 channels:
   conda-forge:
     subdirs: [linux-64, noarch]
     allowlist_file: /test/conda-forge-allowlist.txt
+    environment_files: [/test/environment.yml, /test/environments]
+    lockfiles: [/test/conda-lock.yml]
+    denylist_file: /test/conda-forge-denylist.txt
+    include_constrains: true
+    min_age_days: 7
+    min_age_exempt: [openssl, "ca-certificates >=2023"]
+    prefer_conda: true
+    max_package_size_mb: 500
+    max_package_size_overrides:
+      pytorch: 2000
+    license_policy:
+      allow_osi_approved: true
+      deny: [AGPL-3.0-only]
+      fallback: allow
+    build_policy:
+      exclude: ["*cuda*"]
+      include: ["pytorch * *cpu*"]
+      exclude_track_features: [pypy]
+    virtual_packages:
+      linux-64:
+        __glibc: "2.17"
+        __unix:
+    retention:
+      keep_versions: 3
+      keep_months: 12
+    patch_instructions:
+      noarch: /test/noarch/patch_instructions.json
   test:
     subdirs: [osx-64]
+tenants:
+  team-a:
+    token: secret
+    channels:
+      conda-forge:
+        allowlist_file: /test/team-a.txt
 `
 	tmpdir := t.TempDir()
 	configFile := filepath.Join(tmpdir, "test.yaml")
@@ -39,10 +73,107 @@ channels:
 	assert.Equal(t, 1440, c.CacheControlMaxAgeMinutes)
 	assert.Equal(t, "repodata-cache/original", c.OriginalRepodataDir)
 	assert.Equal(t, "repodata-cache/filtered-x", c.FilteredRepodataDir)
+	assert.Equal(t, "/test/advisories", c.AdvisoriesDir)
 
 	assert.Equal(t, 2, len(c.Channels))
 	assert.Equal(t, c.Channels["conda-forge"].Subdirs, []string{"linux-64", "noarch"})
 	assert.Equal(t, c.Channels["conda-forge"].AllowlistFile, "/test/conda-forge-allowlist.txt")
 	assert.Equal(t, c.Channels["test"].Subdirs, []string{"osx-64"})
+	assert.Equal(t, c.Channels["conda-forge"].DenylistFile, "/test/conda-forge-denylist.txt")
 	assert.Equal(t, c.Channels["test"].AllowlistFile, "")
+	assert.Equal(t, c.Channels["conda-forge"].EnvironmentFiles, []string{"/test/environment.yml", "/test/environments"})
+	assert.Equal(t, c.Channels["conda-forge"].Lockfiles, []string{"/test/conda-lock.yml"})
+	assert.Equal(t, c.Channels["conda-forge"].MinAgeDays, 7)
+	assert.Equal(t, c.Channels["conda-forge"].MinAgeExempt, []string{"openssl", "ca-certificates >=2023"})
+	assert.Equal(t, c.Channels["test"].DenylistFile, "")
+	assert.True(t, c.Channels["conda-forge"].IncludeConstrains)
+	assert.False(t, c.Channels["test"].IncludeConstrains)
+	assert.True(t, c.Channels["conda-forge"].PreferConda)
+	assert.False(t, c.Channels["test"].PreferConda)
+	assert.Equal(t, 500, c.Channels["conda-forge"].MaxPackageSizeMB)
+	assert.Equal(t, map[string]int{"pytorch": 2000}, c.Channels["conda-forge"].MaxPackageSizeOverrides)
+	assert.Equal(t, 0, c.Channels["test"].MaxPackageSizeMB)
+	assert.Equal(t, c.Channels["conda-forge"].LicensePolicy, &licensePolicyConfig{
+		AllowOsiApproved: true,
+		Deny:             []string{"AGPL-3.0-only"},
+		Fallback:         "allow",
+	})
+	assert.Equal(t, c.Channels["test"].MinAgeDays, 0)
+	assert.Nil(t, c.Channels["test"].LicensePolicy)
+	assert.Equal(t, c.Channels["conda-forge"].BuildPolicy, &buildPolicyConfig{
+		Exclude:              []string{"*cuda*"},
+		Include:              []string{"pytorch * *cpu*"},
+		ExcludeTrackFeatures: []string{"pypy"},
+	})
+	assert.Nil(t, c.Channels["test"].BuildPolicy)
+	assert.Equal(t, c.Channels["conda-forge"].VirtualPackages, map[string]map[string]string{
+		"linux-64": {"__glibc": "2.17", "__unix": ""},
+	})
+	assert.Nil(t, c.Channels["test"].VirtualPackages)
+	assert.Equal(t, c.Channels["conda-forge"].Retention, &retentionConfig{KeepVersions: 3, KeepMonths: 12})
+	assert.Nil(t, c.Channels["test"].Retention)
+	assert.Equal(t, c.Channels["conda-forge"].PatchInstructions, map[string]string{"noarch": "/test/noarch/patch_instructions.json"})
+
+	assert.Equal(t, map[string]tenantConfig{
+		"team-a": {Token: "secret", Channels: map[string]condaChannelConfig{
+			"conda-forge": {AllowlistFile: "/test/team-a.txt"},
+		}},
+	}, c.Tenants)
+}
+
+func TestConfigTenant(t *testing.T) {
+	c := &CondaRepoConfig{
+		FilteredRepodataDir: "filtered",
+		Channels: map[string]condaChannelConfig{
+			"conda-forge": {Subdirs: []string{"linux-64", "noarch"}, AllowlistFile: "all.txt"},
+			"bioconda":    {Subdirs: []string{"noarch"}},
+		},
+		Tenants: map[string]tenantConfig{
+			"team-a": {Channels: map[string]condaChannelConfig{
+				"conda-forge": {AllowlistFile: "team-a.txt"},
+			}},
+			"team-b": {Token: "secret", Channels: map[string]condaChannelConfig{
+				"conda-forge": {Subdirs: []string{"noarch"}, RecurseDependencies: true},
+			}},
+			"unknown-channel": {Channels: map[string]condaChannelConfig{
+				"pytorch": {},
+			}},
+			"unknown-subdir": {Channels: map[string]condaChannelConfig{
+				"bioconda": {Subdirs: []string{"linux-64"}},
+			}},
+			"bioconda": {},
+			"t":        {},
+		},
+	}
+
+	assert.Equal(t, []string{"bioconda", "t", "team-a", "team-b", "unknown-channel", "unknown-subdir"}, c.TenantNames())
+
+	a, err := c.Tenant("team-a")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("filtered", "tenants", "team-a"), a.FilteredRepodataDir)
+	assert.Equal(t, map[string]condaChannelConfig{
+		"conda-forge": {Subdirs: []string{"linux-64", "noarch"}, AllowlistFile: "team-a.txt"},
+	}, a.Channels)
+	assert.Nil(t, a.Tenants)
+
+	b, err := c.Tenant("team-b")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]condaChannelConfig{
+		"conda-forge": {Subdirs: []string{"noarch"}, RecurseDependencies: true},
+	}, b.Channels)
+
+	// The top-level config isn't modified
+	assert.Equal(t, "filtered", c.FilteredRepodataDir)
+	assert.Equal(t, "all.txt", c.Channels["conda-forge"].AllowlistFile)
+
+	_, err = c.Tenant("unknown-channel")
+	assert.EqualError(t, err, "tenant unknown-channel: channel pytorch isn't in channels")
+	_, err = c.Tenant("unknown-subdir")
+	assert.EqualError(t, err, "tenant unknown-subdir: subdir bioconda/linux-64 isn't in channels")
+	_, err = c.Tenant("bioconda")
+	assert.EqualError(t, err, "tenant bioconda has the same name as a channel")
+	_, err = c.Tenant("t")
+	assert.EqualError(t, err, "invalid tenant name: t")
+	_, err = c.Tenant("team-c")
+	assert.EqualError(t, err, "unknown tenant: team-c")
 }
@@ -0,0 +1,448 @@
+// Version-aware dependency resolution
+package repodata
+
+import (
+	"log"
+	"sort"
+)
+
+// IndexedRecord is a repodata record with its filename and parsed version
+type IndexedRecord struct {
+	// Filename including the subdir, e.g. linux-64/foo-1.0-0.conda
+	Filename string
+	Record   RepodataRecord
+	version  *Version
+}
+
+// excludedRecord is a record that can't be used to satisfy a dependency
+type excludedRecord struct {
+	*IndexedRecord
+	rule string
+}
+
+// PackageIndex indexes repodata records by name so that dependency MatchSpecs can be resolved
+type PackageIndex struct {
+	records map[string][]*IndexedRecord
+	// Records excluded by a policy rule, used to explain missing dependencies
+	excluded map[string][]excludedRecord
+	// Cache of resolved dependency MatchSpecs
+	resolved map[string][]*IndexedRecord
+}
+
+func NewPackageIndex() *PackageIndex {
+	return &PackageIndex{
+		records:  make(map[string][]*IndexedRecord),
+		excluded: make(map[string][]excludedRecord),
+		resolved: make(map[string][]*IndexedRecord),
+	}
+}
+
+// Add adds the records in repodata to the index
+//
+// Records that are excluded by the policy (ignoring the allowlist and denylist)
+// or its retention policy are not used to satisfy dependencies. The denylist is
+// applied after dependencies are expanded, so denied records still satisfy
+// dependencies and their own dependencies are allowed.
+func (idx *PackageIndex) Add(repodata *Repodata, policy *FilterPolicy) {
+	allowed := []*IndexedRecord{}
+	denied := []*IndexedRecord{}
+	for _, packages := range []map[string]RepodataRecord{repodata.Packages, repodata.PackagesConda} {
+		for k, v := range packages {
+			version, err := ParseVersion(v.Version)
+			if err != nil {
+				log.Printf("Ignoring %s/%s: %s", v.Subdir, k, err)
+				continue
+			}
+			r := &IndexedRecord{Filename: v.Subdir + "/" + k, Record: v, version: version}
+			if rule, _ := checkRules(r.Filename, &r.Record, policy, false); rule != "" {
+				idx.excluded[v.Name] = append(idx.excluded[v.Name], excludedRecord{r, rule})
+			} else if policy != nil && packageIsDenied(&r.Record, policy.Denied) != nil {
+				// Denied records are removed before the retention policy is applied
+				// to the filtered repodata, so they don't count towards it here
+				denied = append(denied, r)
+			} else {
+				allowed = append(allowed, r)
+			}
+		}
+	}
+
+	removed := map[string]string{}
+	if policy != nil && policy.Retention != nil {
+		removed = policy.Retention.apply(allowed, policy.Allowed, policy.LockedFiles, policy.now())
+	}
+	for _, r := range allowed {
+		if _, ok := removed[r.Filename]; ok {
+			idx.excluded[r.Record.Name] = append(idx.excluded[r.Record.Name], excludedRecord{r, RuleRetention})
+		} else {
+			idx.records[r.Record.Name] = append(idx.records[r.Record.Name], r)
+		}
+	}
+	for _, r := range denied {
+		idx.records[r.Record.Name] = append(idx.records[r.Record.Name], r)
+	}
+	idx.resolved = make(map[string][]*IndexedRecord)
+}
+
+// Names returns the names of all packages in the index
+func (idx *PackageIndex) Names() *Set {
+	names := NewSet(nil)
+	for name := range idx.records {
+		names.Add(name)
+	}
+	return names
+}
+
+// Resolve returns the records matching a dependency MatchSpec
+func (idx *PackageIndex) Resolve(dependency string) []*IndexedRecord {
+	if records, ok := idx.resolved[dependency]; ok {
+		return records
+	}
+
+	records := []*IndexedRecord{}
+	if spec, err := ParseMatchSpec(dependency); err != nil {
+		log.Printf("Ignoring invalid dependency %s: %s", dependency, err)
+	} else {
+		for _, r := range idx.records[spec.Name] {
+			if spec.MatchesVersionBuild(r.version, r.Record.Build) {
+				records = append(records, r)
+			}
+		}
+	}
+	idx.resolved[dependency] = records
+	return records
+}
+
+// excludedRule returns the rule that excluded the records matching a dependency,
+// or RuleNotFound if there are no matching records
+func (idx *PackageIndex) excludedRule(dependency string) string {
+	if spec, err := ParseMatchSpec(dependency); err == nil {
+		for _, r := range idx.excluded[spec.Name] {
+			if spec.MatchesVersionBuild(r.version, r.Record.Build) {
+				return r.rule
+			}
+		}
+	}
+	return RuleNotFound
+}
+
+// MissingDependency is a dependency of a record in a DependencyClosure that
+// couldn't be satisfied
+type MissingDependency struct {
+	// Filename of the record with the dependency
+	Filename   string
+	Dependency string
+	// Rule that excluded the matching records, or RuleNotFound
+	Rule string
+}
+
+// DependencyClosure is the set of records required by a list of root packages
+type DependencyClosure struct {
+	// Filenames of all records in the closure, including the subdir
+	Filenames *Set
+	// Maps a filename to the filename of the record that first required it,
+	// roots are not included
+	parents map[string]string
+	// Records in the closure indexed by filename
+	records map[string]*IndexedRecord
+	Missing []MissingDependency
+}
+
+// recordConstrains returns the constrains (run_constrained) MatchSpecs of a record
+func recordConstrains(record *RepodataRecord) []string {
+	values, _ := record.Extra["constrains"].([]interface{})
+	constrains := []string{}
+	for _, v := range values {
+		if c, ok := v.(string); ok {
+			constrains = append(constrains, c)
+		}
+	}
+	return constrains
+}
+
+// GetChannelPackageDependencies recursively finds all records required by the
+// records matching roots, including the matching records themselves
+//
+// Only the records satisfying each dependency MatchSpec are added. If a package
+// is in roots with a version constraint, dependencies on other versions are not
+// satisfied. If includeConstrains is true the records satisfying each constrains
+// MatchSpec are treated as optional dependencies, they're added if they exist
+// but aren't reported as missing.
+func GetChannelPackageDependencies(idx *PackageIndex, roots *PackageList, includeConstrains bool) *DependencyClosure {
+	closure := &DependencyClosure{
+		Filenames: NewSet(nil),
+		parents:   make(map[string]string),
+		records:   make(map[string]*IndexedRecord),
+		Missing:   []MissingDependency{},
+	}
+
+	pending := []*IndexedRecord{}
+	for _, name := range *roots.MatchingNames(idx.Names()).Items() {
+		for _, r := range idx.records[name] {
+			if roots.Matches(&r.Record) {
+				closure.Filenames.Add(r.Filename)
+				closure.records[r.Filename] = r
+				pending = append(pending, r)
+			}
+		}
+	}
+
+	for len(pending) > 0 {
+		r := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		// Adds the records matching a dependency to the closure, returns false if there are none
+		add := func(dep string) bool {
+			satisfied := false
+			for _, d := range idx.Resolve(dep) {
+				// Respect version constraints on packages in the roots
+				if roots.ContainsName(d.Record.Name) && !roots.Matches(&d.Record) {
+					continue
+				}
+				satisfied = true
+				if !closure.Filenames.Contains(d.Filename) {
+					closure.Filenames.Add(d.Filename)
+					closure.parents[d.Filename] = r.Filename
+					closure.records[d.Filename] = d
+					pending = append(pending, d)
+				}
+			}
+			return satisfied
+		}
+
+		for _, dep := range r.Record.Depends {
+			if !isVirtualPackage(dep) && !add(dep) {
+				closure.Missing = append(closure.Missing, MissingDependency{r.Filename, dep, idx.excludedRule(dep)})
+			}
+		}
+		if includeConstrains {
+			for _, c := range recordConstrains(&r.Record) {
+				if !isVirtualPackage(c) {
+					add(c)
+				}
+			}
+		}
+	}
+
+	sort.Slice(closure.Missing, func(i, j int) bool {
+		if closure.Missing[i].Filename != closure.Missing[j].Filename {
+			return closure.Missing[i].Filename < closure.Missing[j].Filename
+		}
+		return closure.Missing[i].Dependency < closure.Missing[j].Dependency
+	})
+	return closure
+}
+
+// Root returns the filename of the root record that first required a record
+func (c *DependencyClosure) Root(filename string) string {
+	for {
+		parent, ok := c.parents[filename]
+		if !ok {
+			return filename
+		}
+		filename = parent
+	}
+}
+
+// Chain returns the filenames of the records from the root record to a record,
+// or nil if the record isn't in the closure
+func (c *DependencyClosure) Chain(filename string) []string {
+	if !c.Filenames.Contains(filename) {
+		return nil
+	}
+	chain := []string{filename}
+	for {
+		parent, ok := c.parents[filename]
+		if !ok {
+			break
+		}
+		chain = append([]string{parent}, chain...)
+		filename = parent
+	}
+	return chain
+}
+
+// FindDeniedDependencies finds the roots of a closure that depend directly or
+// indirectly on a denied record
+//
+// Only records in the closure are followed, so a root is only reported if one of
+// its dependencies resolves to a record matching the denylist, e.g. a denylist
+// entry `c <2` doesn't affect a root that depends on `c >=2`. Returns a map of
+// root package names to the names of the denied packages they depend on.
+func FindDeniedDependencies(idx *PackageIndex, closure *DependencyClosure, denied *PackageList) map[string]*Set {
+	lost := make(map[string]*Set)
+	if denied == nil {
+		return lost
+	}
+
+	// Records in the closure with each dependency
+	dependents := make(map[string][]*IndexedRecord)
+	deniedRecords := make(map[string][]*IndexedRecord)
+	for _, r := range closure.records {
+		for _, dep := range r.Record.Depends {
+			if !isVirtualPackage(dep) {
+				dependents[dep] = append(dependents[dep], r)
+			}
+		}
+		if denied.Matches(&r.Record) {
+			deniedRecords[r.Record.Name] = append(deniedRecords[r.Record.Name], r)
+		}
+	}
+
+	// Walk up the reverse dependency graph from the denied records of each package
+	for deniedName, records := range deniedRecords {
+		reached := NewSet(nil)
+		for _, r := range records {
+			reached.Add(r.Filename)
+		}
+		done := NewSet(nil)
+		for changed := true; changed; {
+			changed = false
+			for dep, records := range dependents {
+				if done.Contains(dep) {
+					continue
+				}
+				for _, d := range idx.Resolve(dep) {
+					if reached.Contains(d.Filename) {
+						done.Add(dep)
+						for _, r := range records {
+							reached.Add(r.Filename)
+						}
+						changed = true
+						break
+					}
+				}
+			}
+		}
+
+		for _, filename := range *reached.Items() {
+			r := closure.records[filename]
+			// Only roots are reported, they don't have a parent
+			if _, ok := closure.parents[filename]; ok || r.Record.Name == deniedName {
+				continue
+			}
+			if _, ok := lost[r.Record.Name]; !ok {
+				lost[r.Record.Name] = NewSet(nil)
+			}
+			lost[r.Record.Name].Add(deniedName)
+		}
+	}
+	return lost
+}
+
+// PlatformSubdirs returns the subdirs that need their own dependency analysis,
+// and whether noarch should be included with each of them
+//
+// noarch packages can depend on platform packages and vice versa so noarch is
+// always included. noarch is only analysed on its own if there are no platforms.
+func PlatformSubdirs(subdirs []string) ([]string, bool) {
+	platforms := []string{}
+	noarch := false
+	for _, subdir := range subdirs {
+		if subdir == "noarch" {
+			noarch = true
+		} else {
+			platforms = append(platforms, subdir)
+		}
+	}
+	if len(platforms) == 0 && noarch {
+		platforms = append(platforms, "noarch")
+	}
+	return platforms, noarch
+}
+
+// PlatformDependencies are the dependency closures of a channel for each platform subdir
+type PlatformDependencies struct {
+	// Closures indexed by platform subdir, noarch is only analysed on its own
+	// if there are no platform subdirs
+	Closures map[string]*DependencyClosure
+	// Filenames of all records in any closure, including the subdir
+	Filenames *Set
+	// Maps root package names to the names of the denied packages they depend
+	// on in any platform subdir
+	Denied map[string]*Set
+}
+
+// ResolvePlatformDependencies computes the dependency closure of roots for each
+// platform subdir, with the noarch records included in each platform
+//
+// load is called once for each subdir to get its repodata. Records excluded by
+// policy are not used to satisfy dependencies, see PackageIndex.Add.
+func ResolvePlatformDependencies(subdirs []string, load func(subdir string) *Repodata, roots *PackageList, policy *FilterPolicy, includeConstrains bool) *PlatformDependencies {
+	deps := &PlatformDependencies{
+		Closures:  make(map[string]*DependencyClosure),
+		Filenames: NewSet(nil),
+		Denied:    make(map[string]*Set),
+	}
+
+	platforms, includeNoarch := PlatformSubdirs(subdirs)
+	var noarch *Repodata = nil
+	if includeNoarch {
+		noarch = load("noarch")
+	}
+
+	var denied *PackageList = nil
+	if policy != nil {
+		denied = policy.Denied
+	}
+	for _, subdir := range platforms {
+		idx := NewPackageIndex()
+		if noarch != nil {
+			idx.Add(noarch, policy)
+		}
+		if subdir != "noarch" {
+			idx.Add(load(subdir), policy)
+		}
+		closure := GetChannelPackageDependencies(idx, roots, includeConstrains)
+		log.Printf("subdir:[%s] dependencyClosure:[%d]", subdir, closure.Filenames.Len())
+		deps.Closures[subdir] = closure
+		for _, f := range *closure.Filenames.Items() {
+			deps.Filenames.Add(f)
+		}
+		for root, names := range FindDeniedDependencies(idx, closure, denied) {
+			if _, ok := deps.Denied[root]; !ok {
+				deps.Denied[root] = NewSet(nil)
+			}
+			for _, name := range *names.Items() {
+				deps.Denied[root].Add(name)
+			}
+		}
+	}
+	return deps
+}
+
+// UnsatisfiableConstraint is a constrains MatchSpec of a record that can never
+// be met because the package is in the index but none of its records match
+type UnsatisfiableConstraint struct {
+	// Filename of the record with the constraint
+	Filename   string
+	Constraint string
+}
+
+// UnsatisfiableConstrains finds the constrains MatchSpecs of the records in the
+// index that can't be met by any record in the index
+//
+// A constraint on a package that isn't in the index is always met since the
+// package can't be installed.
+func (idx *PackageIndex) UnsatisfiableConstrains() []UnsatisfiableConstraint {
+	unsatisfiable := []UnsatisfiableConstraint{}
+	for _, records := range idx.records {
+		for _, r := range records {
+			for _, c := range recordConstrains(&r.Record) {
+				spec, err := ParseMatchSpec(c)
+				if err != nil || isVirtualPackage(c) || len(idx.records[spec.Name]) == 0 {
+					continue
+				}
+				if len(idx.Resolve(c)) == 0 {
+					unsatisfiable = append(unsatisfiable, UnsatisfiableConstraint{r.Filename, c})
+				}
+			}
+		}
+	}
+	sort.Slice(unsatisfiable, func(i, j int) bool {
+		if unsatisfiable[i].Filename != unsatisfiable[j].Filename {
+			return unsatisfiable[i].Filename < unsatisfiable[j].Filename
+		}
+		return unsatisfiable[i].Constraint < unsatisfiable[j].Constraint
+	})
+	return unsatisfiable
+}
@@ -0,0 +1,311 @@
+package repodata
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPackageIndex(t *testing.T, policy *FilterPolicy) *PackageIndex {
+	idx := NewPackageIndex()
+	idx.Add(loadTestdataRepodata(t, "noarch/repodata.json"), policy)
+	idx.Add(loadTestdataRepodata(t, "linux-64/repodata.json"), policy)
+	return idx
+}
+
+func TestPackageIndexResolve(t *testing.T) {
+	idx := newTestPackageIndex(t, nil)
+
+	testCases := []struct {
+		dependency string
+		expected   []string
+	}{
+		{"a", []string{"noarch/a-0.1.0-0.tar.bz2", "noarch/a-0.2.0-abc_0.tar.bz2"}},
+		{"a >0.1", []string{"noarch/a-0.2.0-abc_0.tar.bz2"}},
+		{"a * abc_*", []string{"noarch/a-0.2.0-abc_0.tar.bz2"}},
+		{"c <=3", []string{"noarch/c-1.2.3-aaa_0.conda"}},
+		{"c >=2", []string{}},
+		{"d", []string{"linux-64/d-2023.1.1-0.conda"}},
+		{"z", []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.dependency, func(t *testing.T) {
+			filenames := []string{}
+			for _, r := range idx.Resolve(tc.dependency) {
+				filenames = append(filenames, r.Filename)
+			}
+			assert.ElementsMatch(t, tc.expected, filenames)
+		})
+	}
+}
+
+func TestGetChannelPackageDependencies(t *testing.T) {
+	testCases := []struct {
+		roots    []string
+		denied   []string
+		expected []string
+		missing  []MissingDependency
+	}{
+		{
+			[]string{"a"},
+			nil,
+			[]string{"noarch/a-0.1.0-0.tar.bz2", "noarch/a-0.2.0-abc_0.tar.bz2", "noarch/b-1-10.tar.bz2", "noarch/c-1.2.3-aaa_0.conda", "linux-64/d-2023.1.1-0.conda"},
+			[]MissingDependency{
+				{"noarch/a-0.1.0-0.tar.bz2", "c >=2", RuleNotFound},
+				{"noarch/a-0.2.0-abc_0.tar.bz2", "c >=2", RuleNotFound},
+			},
+		},
+		{
+			[]string{"a 0.1.0"},
+			nil,
+			[]string{"noarch/a-0.1.0-0.tar.bz2", "noarch/b-1-10.tar.bz2", "noarch/c-1.2.3-aaa_0.conda"},
+			[]MissingDependency{
+				{"noarch/a-0.1.0-0.tar.bz2", "c >=2", RuleNotFound},
+			},
+		},
+		{
+			// The denylist is applied after recursion, denied records still satisfy dependencies
+			[]string{"b", "d"},
+			[]string{"c"},
+			[]string{"noarch/b-1-10.tar.bz2", "noarch/c-1.2.3-aaa_0.conda", "linux-64/d-2023.1.1-0.conda"},
+			[]MissingDependency{},
+		},
+		{
+			// Version constraints on roots also apply to dependencies
+			[]string{"b", "c >=2"},
+			nil,
+			[]string{"noarch/b-1-10.tar.bz2"},
+			[]MissingDependency{
+				{"noarch/b-1-10.tar.bz2", "c <=3", RuleNotFound},
+			},
+		},
+		{
+			[]string{"e", "z"},
+			nil,
+			[]string{"linux-64/e-12.34.56-78.conda"},
+			[]MissingDependency{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.roots, tc.denied), func(t *testing.T) {
+			policy := &FilterPolicy{}
+			if tc.denied != nil {
+				policy.Denied = newTestPackageList(t, tc.denied...)
+			}
+			idx := newTestPackageIndex(t, policy)
+			closure := GetChannelPackageDependencies(idx, newTestPackageList(t, tc.roots...), false)
+			assert.ElementsMatch(t, tc.expected, *closure.Filenames.Items())
+			assert.Equal(t, tc.missing, closure.Missing)
+		})
+	}
+}
+
+func TestGetChannelPackageDependenciesExcluded(t *testing.T) {
+	builds, err := NewBuildPolicy([]string{"aaa_*"}, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Records excluded by other rules can't satisfy dependencies
+	idx := newTestPackageIndex(t, &FilterPolicy{Builds: builds})
+	closure := GetChannelPackageDependencies(idx, newTestPackageList(t, "b", "d"), false)
+	assert.ElementsMatch(t, []string{"noarch/b-1-10.tar.bz2", "linux-64/d-2023.1.1-0.conda"}, *closure.Filenames.Items())
+	assert.Equal(t, []MissingDependency{
+		{"linux-64/d-2023.1.1-0.conda", "c", RuleBuild},
+		{"noarch/b-1-10.tar.bz2", "c <=3", RuleBuild},
+	}, closure.Missing)
+}
+
+func TestFindDeniedDependencies(t *testing.T) {
+	testCases := []struct {
+		roots    []string
+		denied   []string
+		expected map[string][]string
+	}{
+		{[]string{"a", "e"}, []string{"c"}, map[string][]string{"a": {"c"}}},
+		{[]string{"b", "d", "e"}, []string{"c >=1"}, map[string][]string{"b": {"c"}, "d": {"c"}}},
+		// Only versions that are resolved as dependencies are denied
+		{[]string{"b", "d", "e"}, []string{"c <1"}, map[string][]string{}},
+		{[]string{"a 0.1.0"}, []string{"d"}, map[string][]string{}},
+		{[]string{"a", "d"}, []string{"b", "d"}, map[string][]string{"a": {"b", "d"}}},
+		{[]string{"a", "e"}, []string{"re:[bd]"}, map[string][]string{"a": {"b", "d"}}},
+		{[]string{"c", "e"}, []string{"c"}, map[string][]string{}},
+		{[]string{"a"}, nil, map[string][]string{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.roots, tc.denied), func(t *testing.T) {
+			var denied *PackageList
+			if tc.denied != nil {
+				denied = newTestPackageList(t, tc.denied...)
+			}
+			idx := newTestPackageIndex(t, &FilterPolicy{Denied: denied})
+			closure := GetChannelPackageDependencies(idx, newTestPackageList(t, tc.roots...), false)
+			lost := FindDeniedDependencies(idx, closure, denied)
+			assert.Equal(t, len(tc.expected), len(lost))
+			for root, expected := range tc.expected {
+				assert.ElementsMatch(t, expected, *lost[root].Items())
+			}
+		})
+	}
+}
+
+func TestPlatformSubdirs(t *testing.T) {
+	platforms, noarch := PlatformSubdirs([]string{"linux-64", "noarch", "osx-arm64"})
+	assert.Equal(t, []string{"linux-64", "osx-arm64"}, platforms)
+	assert.True(t, noarch)
+
+	platforms, noarch = PlatformSubdirs([]string{"noarch"})
+	assert.Equal(t, []string{"noarch"}, platforms)
+	assert.True(t, noarch)
+
+	platforms, noarch = PlatformSubdirs([]string{"win-64"})
+	assert.Equal(t, []string{"win-64"}, platforms)
+	assert.False(t, noarch)
+}
+
+// newTestLoader returns a function that loads repodata for a subdir, and the
+// number of times each subdir was loaded
+func newTestLoader(t *testing.T, subdirs map[string]*Repodata) (func(string) *Repodata, map[string]int) {
+	loaded := make(map[string]int)
+	return func(subdir string) *Repodata {
+		data, ok := subdirs[subdir]
+		if !ok {
+			t.Fatalf("Unexpected subdir: %s", subdir)
+		}
+		loaded[subdir]++
+		return data
+	}, loaded
+}
+
+func TestResolvePlatformDependenciesNoarch(t *testing.T) {
+	load, loaded := newTestLoader(t, map[string]*Repodata{
+		"noarch": loadTestdataRepodata(t, "noarch/repodata.json"),
+	})
+	deps := ResolvePlatformDependencies([]string{"noarch"}, load, newTestPackageList(t, "b"), nil, false)
+
+	assert.Equal(t, map[string]int{"noarch": 1}, loaded)
+	assert.Equal(t, 1, len(deps.Closures))
+	assert.ElementsMatch(t, []string{"noarch/b-1-10.tar.bz2", "noarch/c-1.2.3-aaa_0.conda"}, *deps.Closures["noarch"].Filenames.Items())
+	assert.ElementsMatch(t, []string{"noarch/b-1-10.tar.bz2", "noarch/c-1.2.3-aaa_0.conda"}, *deps.Filenames.Items())
+	assert.Empty(t, deps.Closures["noarch"].Missing)
+}
+
+func TestResolvePlatformDependenciesMixed(t *testing.T) {
+	load, loaded := newTestLoader(t, map[string]*Repodata{
+		"noarch":   loadTestdataRepodata(t, "noarch/repodata.json"),
+		"linux-64": loadTestdataRepodata(t, "linux-64/repodata.json"),
+		"osx-64": {
+			Info: RepodataInfo{Subdir: "osx-64"},
+			PackagesConda: map[string]RepodataRecord{
+				"e-1-0.conda": {Subdir: "osx-64", Name: "e", Version: "1", Build: "0"},
+			},
+		},
+	})
+	policy := &FilterPolicy{Denied: newTestPackageList(t, "c")}
+	deps := ResolvePlatformDependencies([]string{"linux-64", "noarch", "osx-64"}, load, newTestPackageList(t, "a 0.2.0", "e"), policy, false)
+
+	// noarch is only loaded once and isn't analysed on its own
+	assert.Equal(t, map[string]int{"noarch": 1, "linux-64": 1, "osx-64": 1}, loaded)
+	assert.Equal(t, 2, len(deps.Closures))
+
+	// The noarch package a depends on the platform package d
+	assert.ElementsMatch(t, []string{
+		"noarch/a-0.2.0-abc_0.tar.bz2", "noarch/b-1-10.tar.bz2", "noarch/c-1.2.3-aaa_0.conda",
+		"linux-64/d-2023.1.1-0.conda", "linux-64/e-12.34.56-78.conda",
+	}, *deps.Closures["linux-64"].Filenames.Items())
+	assert.Equal(t, []MissingDependency{
+		{"noarch/a-0.2.0-abc_0.tar.bz2", "c >=2", RuleNotFound},
+	}, deps.Closures["linux-64"].Missing)
+
+	// d isn't available for osx-64
+	assert.ElementsMatch(t, []string{
+		"noarch/a-0.2.0-abc_0.tar.bz2", "noarch/b-1-10.tar.bz2", "noarch/c-1.2.3-aaa_0.conda", "osx-64/e-1-0.conda",
+	}, *deps.Closures["osx-64"].Filenames.Items())
+	assert.Equal(t, []MissingDependency{
+		{"noarch/a-0.2.0-abc_0.tar.bz2", "c >=2", RuleNotFound},
+		{"noarch/a-0.2.0-abc_0.tar.bz2", "d", RuleNotFound},
+	}, deps.Closures["osx-64"].Missing)
+
+	assert.Equal(t, 6, deps.Filenames.Len())
+	assert.Equal(t, 1, len(deps.Denied))
+	assert.ElementsMatch(t, []string{"c"}, *deps.Denied["a"].Items())
+}
+
+func TestGetChannelPackageDependenciesVirtual(t *testing.T) {
+	idx := NewPackageIndex()
+	idx.Add(&Repodata{
+		Packages: map[string]RepodataRecord{
+			"a-1-0.tar.bz2": {Subdir: "linux-64", Name: "a", Version: "1", Build: "0", Depends: []string{"__glibc >=2.17", "b"}},
+			"b-1-0.tar.bz2": {Subdir: "linux-64", Name: "b", Version: "1", Build: "0"},
+		},
+	}, nil)
+
+	closure := GetChannelPackageDependencies(idx, newTestPackageList(t, "a"), false)
+	assert.ElementsMatch(t, []string{"linux-64/a-1-0.tar.bz2", "linux-64/b-1-0.tar.bz2"}, *closure.Filenames.Items())
+	assert.Empty(t, closure.Missing)
+}
+
+func TestGetChannelPackageDependenciesVirtualProfile(t *testing.T) {
+	profile, err := NewVirtualPackageProfile(map[string]string{"__glibc": "2.17"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	idx := NewPackageIndex()
+	idx.Add(&Repodata{
+		Packages: map[string]RepodataRecord{
+			"a-1-0.tar.bz2": {Subdir: "linux-64", Name: "a", Version: "1", Build: "0", Depends: []string{"b"}},
+			"b-1-0.tar.bz2": {Subdir: "linux-64", Name: "b", Version: "1", Build: "0", Depends: []string{"__glibc >=2.17"}},
+			"b-2-0.tar.bz2": {Subdir: "linux-64", Name: "b", Version: "2", Build: "0", Depends: []string{"__glibc >=2.28"}},
+		},
+	}, &FilterPolicy{VirtualPackages: map[string]*VirtualPackageProfile{"linux-64": profile}})
+
+	closure := GetChannelPackageDependencies(idx, newTestPackageList(t, "a"), false)
+	assert.ElementsMatch(t, []string{"linux-64/a-1-0.tar.bz2", "linux-64/b-1-0.tar.bz2"}, *closure.Filenames.Items())
+	assert.Empty(t, closure.Missing)
+}
+
+func TestDependencyClosureRoot(t *testing.T) {
+	idx := newTestPackageIndex(t, nil)
+	closure := GetChannelPackageDependencies(idx, newTestPackageList(t, "a 0.2.0"), false)
+
+	assert.Equal(t, "noarch/a-0.2.0-abc_0.tar.bz2", closure.Root("noarch/a-0.2.0-abc_0.tar.bz2"))
+	assert.Equal(t, "noarch/a-0.2.0-abc_0.tar.bz2", closure.Root("linux-64/d-2023.1.1-0.conda"))
+	assert.Equal(t, "noarch/a-0.2.0-abc_0.tar.bz2", closure.Root("noarch/c-1.2.3-aaa_0.conda"))
+
+	assert.Equal(t, []string{"noarch/a-0.2.0-abc_0.tar.bz2"}, closure.Chain("noarch/a-0.2.0-abc_0.tar.bz2"))
+	assert.Equal(t, []string{"noarch/a-0.2.0-abc_0.tar.bz2", "linux-64/d-2023.1.1-0.conda"}, closure.Chain("linux-64/d-2023.1.1-0.conda"))
+	assert.Nil(t, closure.Chain("noarch/a-0.1.0-0.tar.bz2"))
+}
+
+func newConstrainsTestIndex() *PackageIndex {
+	idx := NewPackageIndex()
+	idx.Add(&Repodata{
+		Packages: map[string]RepodataRecord{
+			"a-1-0.tar.bz2": {Subdir: "linux-64", Name: "a", Version: "1", Build: "0", Extra: map[string]interface{}{
+				"constrains": []interface{}{"b >=2", "c <1", "__cuda >=12"},
+			}},
+			"b-1-0.tar.bz2": {Subdir: "linux-64", Name: "b", Version: "1", Build: "0"},
+			"b-2-0.tar.bz2": {Subdir: "linux-64", Name: "b", Version: "2", Build: "0"},
+			"c-1-0.tar.bz2": {Subdir: "linux-64", Name: "c", Version: "1", Build: "0"},
+		},
+	}, nil)
+	return idx
+}
+
+func TestGetChannelPackageDependenciesConstrains(t *testing.T) {
+	idx := newConstrainsTestIndex()
+
+	closure := GetChannelPackageDependencies(idx, newTestPackageList(t, "a"), false)
+	assert.ElementsMatch(t, []string{"linux-64/a-1-0.tar.bz2"}, *closure.Filenames.Items())
+
+	closure = GetChannelPackageDependencies(idx, newTestPackageList(t, "a"), true)
+	assert.ElementsMatch(t, []string{"linux-64/a-1-0.tar.bz2", "linux-64/b-2-0.tar.bz2"}, *closure.Filenames.Items())
+	assert.Empty(t, closure.Missing)
+}
+
+func TestPackageIndexUnsatisfiableConstrains(t *testing.T) {
+	idx := newConstrainsTestIndex()
+	assert.Equal(t, []UnsatisfiableConstraint{{"linux-64/a-1-0.tar.bz2", "c <1"}}, idx.UnsatisfiableConstrains())
+}
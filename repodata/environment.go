@@ -0,0 +1,158 @@
+// Conda environment.yml files
+// https://docs.conda.io/projects/conda/en/latest/user-guide/tasks/manage-environments.html#create-env-file-manually
+package repodata
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment is a parsed conda environment.yml file
+type Environment struct {
+	Filename string
+	Name     string
+	// Channel names or URLs
+	Channels []string
+	// Conda MatchSpecs
+	Dependencies []string
+	// pip requirements, these aren't installed from a conda channel
+	PipDependencies []string
+}
+
+type environmentFile struct {
+	Name         string        `yaml:"name"`
+	Channels     []string      `yaml:"channels"`
+	Dependencies []interface{} `yaml:"dependencies"`
+}
+
+// LoadEnvironment loads an environment.yml file
+func LoadEnvironment(filename string) (*Environment, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f environmentFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	env := &Environment{
+		Filename:        filename,
+		Name:            f.Name,
+		Channels:        f.Channels,
+		Dependencies:    []string{},
+		PipDependencies: []string{},
+	}
+	for _, dep := range f.Dependencies {
+		switch d := dep.(type) {
+		case string:
+			env.Dependencies = append(env.Dependencies, d)
+		case map[string]interface{}:
+			pip, ok := d["pip"].([]interface{})
+			if !ok || len(d) != 1 {
+				return nil, fmt.Errorf("%s: invalid dependency: %v", filename, d)
+			}
+			for _, p := range pip {
+				s, ok := p.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: invalid pip dependency: %v", filename, p)
+				}
+				env.PipDependencies = append(env.PipDependencies, s)
+			}
+		default:
+			return nil, fmt.Errorf("%s: invalid dependency: %v", filename, d)
+		}
+	}
+	return env, nil
+}
+
+// LoadEnvironments loads an environment file, or all .yml and .yaml files in a
+// directory (recursively)
+func LoadEnvironments(path string) ([]*Environment, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		env, err := LoadEnvironment(path)
+		if err != nil {
+			return nil, err
+		}
+		return []*Environment{env}, nil
+	}
+
+	envs := []*Environment{}
+	err = filepath.WalkDir(path, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !(strings.HasSuffix(filename, ".yml") || strings.HasSuffix(filename, ".yaml")) {
+			return nil
+		}
+		env, err := LoadEnvironment(filename)
+		if err != nil {
+			return err
+		}
+		envs = append(envs, env)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return envs, nil
+}
+
+// channelMatches returns true if an environment channel name or URL refers to channel
+func channelMatches(envChannel string, channel string) bool {
+	envChannel = strings.TrimSuffix(envChannel, "/")
+	return envChannel == channel || strings.HasSuffix(envChannel, "/"+channel)
+}
+
+// UsesChannel returns true if the environment's channels include channel. An
+// environment without any channels uses all channels.
+func (e *Environment) UsesChannel(channel string) bool {
+	if len(e.Channels) == 0 {
+		return true
+	}
+	for _, c := range e.Channels {
+		if channelMatches(c, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Specs returns the MatchSpecs of the conda dependencies that can be installed
+// from channel
+//
+// Dependencies with a channel prefix (e.g. "conda-forge::numpy") only apply to
+// that channel, other dependencies apply to all channels in the environment.
+// If there are pip dependencies pip is also included.
+func (e *Environment) Specs(channel string) ([]*MatchSpec, error) {
+	specs := []*MatchSpec{}
+	hasPip := false
+	for _, dep := range e.Dependencies {
+		spec, err := ParseMatchSpec(dep)
+		if err != nil {
+			return nil, errors.New(e.Filename + ": " + err.Error())
+		}
+		if spec.Channel != "" && !channelMatches(spec.Channel, channel) {
+			continue
+		}
+		if spec.Channel == "" && !e.UsesChannel(channel) {
+			continue
+		}
+		hasPip = hasPip || spec.Name == "pip"
+		specs = append(specs, spec)
+	}
+	if len(e.PipDependencies) > 0 && !hasPip && e.UsesChannel(channel) {
+		specs = append(specs, &MatchSpec{raw: "pip", Name: "pip"})
+	}
+	return specs, nil
+}
@@ -0,0 +1,96 @@
+package repodata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func specStrings(specs []*MatchSpec) []string {
+	s := []string{}
+	for _, spec := range specs {
+		s = append(s, spec.String())
+	}
+	return s
+}
+
+func TestLoadEnvironment(t *testing.T) {
+	env, err := LoadEnvironment("testdata/environments/data-science.yml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, "data-science", env.Name)
+	assert.Equal(t, []string{"conda-forge", "nodefaults"}, env.Channels)
+	assert.Equal(t, []string{"python=3.11", "numpy >=1.24,<2", "pytorch::pytorch 2.1.*"}, env.Dependencies)
+	assert.Equal(t, []string{"requests==2.31.0", "-e ."}, env.PipDependencies)
+}
+
+func TestLoadEnvironmentInvalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "environment.yml")
+	if err := os.WriteFile(filename, []byte("dependencies:\n  - conda: [numpy]\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err := LoadEnvironment(filename)
+	assert.ErrorContains(t, err, "invalid dependency")
+}
+
+func TestLoadEnvironments(t *testing.T) {
+	envs, err := LoadEnvironments("testdata/environments")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	names := []string{}
+	for _, env := range envs {
+		names = append(names, env.Name)
+	}
+	assert.ElementsMatch(t, []string{"data-science", "web"}, names)
+
+	envs, err = LoadEnvironments("testdata/environments/nested/web.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, 1, len(envs))
+}
+
+func TestEnvironmentSpecs(t *testing.T) {
+	envs := map[string]*Environment{}
+	for _, f := range []string{"data-science.yml", "nested/web.yaml"} {
+		env, err := LoadEnvironment("testdata/environments/" + f)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		envs[env.Name] = env
+	}
+
+	testCases := []struct {
+		env      string
+		channel  string
+		expected []string
+	}{
+		{"data-science", "conda-forge", []string{"python=3.11", "numpy >=1.24,<2", "pip"}},
+		{"data-science", "pytorch", []string{"pytorch::pytorch 2.1.*"}},
+		{"data-science", "bioconda", []string{}},
+		{"web", "bioconda", []string{"flask"}},
+		{"web", "conda-forge", []string{"conda-forge::openssl 3.*"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.env+","+tc.channel, func(t *testing.T) {
+			specs, err := envs[tc.env].Specs(tc.channel)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			assert.Equal(t, tc.expected, specStrings(specs))
+		})
+	}
+}
+
+func TestEnvironmentSpecsNoChannels(t *testing.T) {
+	env := &Environment{Dependencies: []string{"numpy", "pip"}, PipDependencies: []string{"requests"}}
+	specs, err := env.Specs("anything")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, []string{"numpy", "pip"}, specStrings(specs))
+}
@@ -5,37 +5,96 @@ package repodata
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
-	"regexp"
 	"strings"
 )
 
-// packageIsAllowed returns true if the name is in allowedPackages, or if allowedPackages is nil
-func packageIsAllowed(name string, allowedPackages *Set) bool {
+// packageIsAllowed returns true if the record matches allowedPackages, or if allowedPackages is nil
+func packageIsAllowed(record *RepodataRecord, allowedPackages *PackageList) bool {
 	if allowedPackages == nil {
 		return true
 	}
-	return allowedPackages.Contains(name)
+	return allowedPackages.Matches(record)
 }
 
-// FilenameIsValid returns true if the filename matches the associated metadata
+// ValidateFilename returns an error if the filename doesn't match the associated metadata
 //
 // > Filename key of each package should be validated against {name}-{version}-{build}{ext} metadata for the package
 // https://github.com/conda/schemas/blob/bd2b05d6a6314b39d9a8c9c9802280c3eb78e788/repodata-1.schema.json#L33
-func FilenameIsValid(filename string, expectedExt string, repodata *Repodata, record *RepodataRecord) bool {
+func ValidateFilename(filename string, expectedExt string, repodata *Repodata, record *RepodataRecord) error {
 	if record.Subdir != repodata.Info.Subdir {
-		log.Printf("Subdir mismatch [%s]: %s != %s", filename, record.Subdir, repodata.Info.Subdir)
-		return false
+		return fmt.Errorf("subdir mismatch: %s != %s", record.Subdir, repodata.Info.Subdir)
 	}
 
 	expectedFilename := record.Name + "-" + record.Version + "-" + record.Build + expectedExt
 	if filename != expectedFilename {
-		log.Printf("Filename does not match metadata: %s != %s", filename, expectedFilename)
-		return false
+		return fmt.Errorf("filename does not match metadata: %s != %s", filename, expectedFilename)
 	}
-	return true
+	return nil
+}
+
+// packageFilenameExtensions are the supported conda package formats
+var packageFilenameExtensions = []string{".tar.bz2", ".conda"}
+
+// ParsePackageFilename returns the name, version and build of a package filename
+// {name}-{version}-{build}{ext}, and false if the filename isn't valid
+func ParsePackageFilename(filename string) (string, string, string, bool) {
+	stem := ""
+	for _, ext := range packageFilenameExtensions {
+		if strings.HasSuffix(filename, ext) {
+			stem = strings.TrimSuffix(filename, ext)
+			break
+		}
+	}
+	buildSep := strings.LastIndex(stem, "-")
+	if buildSep < 0 {
+		return "", "", "", false
+	}
+	versionSep := strings.LastIndex(stem[:buildSep], "-")
+	if versionSep <= 0 {
+		return "", "", "", false
+	}
+	name, version, build := stem[:versionSep], stem[versionSep+1:buildSep], stem[buildSep+1:]
+	if version == "" || build == "" {
+		return "", "", "", false
+	}
+	return name, version, build, true
+}
+
+// filterRemoved returns the filenames in repodata.Removed that are allowed by
+// the policy's allowlist, or are versions of packages in the policy's allowed
+// files such as the dependency closure
+//
+// Removed files aren't in the dependency closure themselves since they're not
+// in packages, so their package names are compared instead.
+func filterRemoved(repodata *Repodata, policy *FilterPolicy) []string {
+	if repodata.Removed == nil || policy == nil || policy.Allowed == nil {
+		return repodata.Removed
+	}
+	allowedNames := NewSet(nil)
+	if policy.AllowedFiles != nil {
+		prefix := repodata.Info.Subdir + "/"
+		for _, f := range *policy.AllowedFiles.Items() {
+			if name, _, _, ok := ParsePackageFilename(strings.TrimPrefix(f, prefix)); ok && strings.HasPrefix(f, prefix) {
+				allowedNames.Add(name)
+			}
+		}
+	}
+	removed := []string{}
+	for _, filename := range repodata.Removed {
+		name, version, build, ok := ParsePackageFilename(filename)
+		if !ok {
+			continue
+		}
+		record := RepodataRecord{Subdir: repodata.Info.Subdir, Name: name, Version: version, Build: build}
+		if packageIsAllowed(&record, policy.Allowed) || policy.allowsFile(record.Subdir+"/"+filename) || allowedNames.Contains(name) {
+			removed = append(removed, filename)
+		}
+	}
+	return removed
 }
 
 func LoadRepodata(repodataFile string) (*Repodata, error) {
@@ -57,17 +116,12 @@ func LoadRepodata(repodataFile string) (*Repodata, error) {
 	return &repodata, nil
 }
 
-// ParseRepodata parses a Conda repodata JSON file, and filters it by allowedPackages
-func ParseRepodata(channel string, repodataFile string, allowedPackages *Set) (*Repodata, *Set, *Set, error) {
-	log.Println("Parsing", repodataFile)
-	repodata, err := LoadRepodata(repodataFile)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	log.Printf("%s packages:[%d] packages.conda:[%d]", repodataFile, len(repodata.Packages), len(repodata.PackagesConda))
-
-	filtered := FilterRepodataByAllowed(repodata, allowedPackages)
+// FilterRepodata filters repodata by policy
+//
+// Returns the filtered repodata, the set of allowed filenames including the
+// channel and subdir, the set of allowed package names, and the excluded records.
+func FilterRepodata(channel string, repodata *Repodata, policy *FilterPolicy) (*Repodata, *Set, *Set, []Exclusion) {
+	filtered, exclusions := FilterRepodataByAllowed(repodata, policy)
 
 	fileNames := NewSet(nil)
 	packageNames := NewSet(nil)
@@ -79,48 +133,77 @@ func ParseRepodata(channel string, repodataFile string, allowedPackages *Set) (*
 		}
 	}
 
-	log.Printf("fileNames:[%d] packageNames:[%d]", fileNames.Len(), packageNames.Len())
-	return filtered, fileNames, packageNames, nil
+	log.Printf("fileNames:[%d] packageNames:[%d] exclusions:[%d]", fileNames.Len(), packageNames.Len(), len(exclusions))
+	return filtered, fileNames, packageNames, exclusions
 }
 
-// FilterRepodataByAllowed checks the repodata and filters packages by allowed
-func FilterRepodataByAllowed(repodata *Repodata, allowed *Set) *Repodata {
-	// Shallow copy, apart from Packages and PackagesConda
+// FilterRepodataByAllowed checks the repodata and filters packages by policy
+//
+// Returns the filtered repodata, and the records that were excluded by a policy
+// rule other than not being in the allowlist. The retention policy is applied
+// to the records that are allowed by all other rules, followed by PreferConda.
+func FilterRepodataByAllowed(repodata *Repodata, policy *FilterPolicy) (*Repodata, []Exclusion) {
+	// Shallow copy, apart from Packages, PackagesConda and Removed
 	filtered := Repodata{
 		RepodataVersion: repodata.RepodataVersion,
 		Info:            repodata.Info,
+		Removed:         filterRemoved(repodata, policy),
+		Extra:           repodata.Extra,
 	}
 	filtered.Packages = make(map[string]RepodataRecord)
 	filtered.PackagesConda = make(map[string]RepodataRecord)
 
-	fileNames := NewSet(nil)
-	packageNames := NewSet(nil)
-
-	for k, v := range repodata.Packages {
-		if !FilenameIsValid(k, ".tar.bz2", &filtered, &v) {
-			log.Println("Filename is not valid", k)
-			continue
-		}
-		if packageIsAllowed(v.Name, allowed) {
-			fileNames.Add(v.Subdir + "/" + k)
-			packageNames.Add(v.Name)
-			filtered.Packages[k] = v
+	exclusions := []Exclusion{}
+
+	for _, packages := range []struct {
+		records  map[string]RepodataRecord
+		filtered map[string]RepodataRecord
+		ext      string
+	}{
+		{repodata.Packages, filtered.Packages, ".tar.bz2"},
+		{repodata.PackagesConda, filtered.PackagesConda, ".conda"},
+	} {
+		for k, v := range packages.records {
+			record := v
+			if err := ValidateFilename(k, packages.ext, &filtered, &record); err != nil {
+				log.Printf("Invalid filename [%s]: %s", k, err)
+				exclusions = append(exclusions, Exclusion{k, record, RuleInvalidFilename, err.Error()})
+				continue
+			}
+			rule, reason := checkRecord(record.Subdir+"/"+k, &record, policy)
+			switch rule {
+			case "":
+				packages.filtered[k] = record
+			case RuleNotAllowed:
+			default:
+				exclusions = append(exclusions, Exclusion{k, record, rule, reason})
+			}
 		}
 	}
+	exclusions = append(exclusions, applyRetention(&filtered, policy)...)
+	exclusions = append(exclusions, applyPreferConda(&filtered, policy)...)
+
+	return &filtered, exclusions
+}
 
-	for k, v := range repodata.PackagesConda {
-		if !FilenameIsValid(k, ".conda", &filtered, &v) {
-			log.Println("Filename is not valid", k)
+// applyPreferConda removes .tar.bz2 records that are also in repodata as .conda
+func applyPreferConda(repodata *Repodata, policy *FilterPolicy) []Exclusion {
+	exclusions := []Exclusion{}
+	if policy == nil || !policy.PreferConda {
+		return exclusions
+	}
+	for k, v := range repodata.Packages {
+		conda := condaFilename(k)
+		if _, ok := repodata.PackagesConda[conda]; !ok {
 			continue
 		}
-		if packageIsAllowed(v.Name, allowed) {
-			fileNames.Add(v.Subdir + "/" + k)
-			packageNames.Add(v.Name)
-			filtered.PackagesConda[k] = v
+		if policy.LockedFiles != nil && policy.LockedFiles.Contains(v.Subdir+"/"+k) {
+			continue
 		}
+		delete(repodata.Packages, k)
+		exclusions = append(exclusions, Exclusion{k, v, RulePreferConda, "available as " + conda})
 	}
-
-	return &filtered
+	return exclusions
 }
 
 // ParseListFromFile parses a plain text file with a list of strings
@@ -146,65 +229,3 @@ func ParseListFromFile(allowedFile string) *Set {
 
 	return allowedPackages
 }
-
-func parseDependencyName(dependency string) string {
-	sep := regexp.MustCompile(`[ ><=]`)
-	parts := sep.Split(dependency, 2)
-	return parts[0]
-}
-
-// UpdateDependencyMap updates a map of package names to their dependencies (all versions combined)
-func UpdateDependencyMap(dependencyMap *map[string]Set, repodata *Repodata) {
-	for _, packages := range []map[string]RepodataRecord{repodata.Packages, repodata.PackagesConda} {
-		for _, v := range packages {
-			if _, ok := (*dependencyMap)[v.Name]; !ok {
-				(*dependencyMap)[v.Name] = *NewSet(nil)
-			}
-			for _, dep := range v.Depends {
-				m := (*dependencyMap)[v.Name]
-				m.Add(parseDependencyName(dep))
-			}
-		}
-	}
-}
-
-// GetChannelPackageDependencies recursively finds the names of all dependencies for a list
-// of packages, including the packages themselves
-func GetChannelPackageDependencies(dependencyMap map[string]Set, packageNames *Set) *Set {
-	allPackageNames := NewSet(nil)
-
-	done := NewSet(nil)
-	pending := NewSet(nil)
-
-	// Add all package names to pending
-	// While pending is not empty:
-	//   Pop a package name from pending
-	//   If package is not in done:
-	//     Find the package in repodata (all subdirs)
-	//     Add all dependencies to pending if not in done
-	//     Add package to done
-
-	for _, name := range *packageNames.Items() {
-		pending.Add(name)
-	}
-
-	for pending.Len() > 0 {
-		name, valid := pending.Pop()
-		if !valid {
-			break
-		}
-
-		if !done.Contains(name) {
-			allPackageNames.Add(name)
-			deps := dependencyMap[name]
-			for _, dep := range *deps.Items() {
-				allPackageNames.Add(dep)
-				if !done.Contains(dep) {
-					pending.Add(dep)
-				}
-			}
-			done.Add(name)
-		}
-	}
-	return allPackageNames
-}
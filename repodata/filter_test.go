@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -43,49 +44,38 @@ func loadTestdataRepodata(t *testing.T, testdataPath string) *Repodata {
 	return &repodata
 }
 
+func newTestPackageList(t *testing.T, specs ...string) *PackageList {
+	l, err := ParsePackageList(specs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return l
+}
+
 func TestPackageIsAllowed(t *testing.T) {
-	allowedPackages := NewSet(&[]string{"foo"})
+	allowedPackages := newTestPackageList(t, "foo", "numpy >=1.24,<2", "pytorch 2.1.* *cuda*")
+
+	assert.True(t, packageIsAllowed(&RepodataRecord{Name: "foo", Version: "1"}, allowedPackages))
+	assert.False(t, packageIsAllowed(&RepodataRecord{Name: "bar", Version: "1"}, allowedPackages))
+	assert.True(t, packageIsAllowed(&RepodataRecord{Name: "bar", Version: "1"}, nil))
 
-	assert.True(t, packageIsAllowed("foo", allowedPackages))
-	assert.False(t, packageIsAllowed("bar", allowedPackages))
-	assert.True(t, packageIsAllowed("bar", nil))
+	assert.True(t, packageIsAllowed(&RepodataRecord{Name: "numpy", Version: "1.26.0"}, allowedPackages))
+	assert.False(t, packageIsAllowed(&RepodataRecord{Name: "numpy", Version: "1.23.5"}, allowedPackages))
+	assert.False(t, packageIsAllowed(&RepodataRecord{Name: "numpy", Version: "2.0.0"}, allowedPackages))
+
+	assert.True(t, packageIsAllowed(&RepodataRecord{Name: "pytorch", Version: "2.1.0", Build: "cuda120_py311h_0"}, allowedPackages))
+	assert.False(t, packageIsAllowed(&RepodataRecord{Name: "pytorch", Version: "2.1.0", Build: "cpu_py311h_0"}, allowedPackages))
+	assert.False(t, packageIsAllowed(&RepodataRecord{Name: "pytorch", Version: "2.0.1", Build: "cuda120_py311h_0"}, allowedPackages))
 }
 
-func TestFilenameIsValid(t *testing.T) {
-	repodataLinux64 := Repodata{
-		RepodataVersion: 1,
-		Info:            RepodataInfo{Subdir: "linux-64"},
-	}
-	repodataWinArm64 := Repodata{
-		RepodataVersion: 1,
-		Info:            RepodataInfo{Subdir: "win-arm64"},
-	}
-	record := RepodataRecord{
-		Subdir:  "linux-64",
-		Name:    "foo",
-		Version: "1.0",
-		Build:   "py_0",
-	}
+func TestValidateFilename(t *testing.T) {
+	repodata := &Repodata{Info: RepodataInfo{Subdir: "win-arm64"}}
+	record := RepodataRecord{Subdir: "linux-64", Name: "foo", Version: "1.0", Build: "py_0"}
+	assert.EqualError(t, ValidateFilename("foo-1.0-py_0.conda", ".conda", repodata, &record), "subdir mismatch: linux-64 != win-arm64")
 
-	testCases := []struct {
-		filename  string
-		repodata  *Repodata
-		extension string
-		valid     bool
-	}{
-		{"foo-1.0-py_0.conda", &repodataLinux64, ".conda", true},
-		{"foo-1.0-py_0.tar.bz2", &repodataLinux64, ".tar.bz2", true},
-		{"foo-1.0-py_x.conda", &repodataLinux64, ".conda", false},
-		{"foo-1.0-py_0.conda", &repodataWinArm64, ".conda", false},
-	}
-	for _, tc := range testCases {
-		t.Run(fmt.Sprintf("%v,%v,%v", tc.filename, tc.repodata, tc.extension), func(t *testing.T) {
-			assert.Equal(t,
-				tc.valid,
-				FilenameIsValid(tc.filename, tc.extension, tc.repodata, &record))
-		},
-		)
-	}
+	repodata.Info.Subdir = "linux-64"
+	assert.EqualError(t, ValidateFilename("foo-1.0-py_x.conda", ".conda", repodata, &record), "filename does not match metadata: foo-1.0-py_x.conda != foo-1.0-py_0.conda")
+	assert.NoError(t, ValidateFilename("foo-1.0-py_0.conda", ".conda", repodata, &record))
 }
 
 func TestLoadRepodata(t *testing.T) {
@@ -116,7 +106,7 @@ func TestLoadRepodata(t *testing.T) {
 	})
 }
 
-func TestParseRepodata(t *testing.T) {
+func TestFilterRepodataTestdata(t *testing.T) {
 	testCases := []struct {
 		subDir                   string
 		expectedFileNames        *[]string
@@ -146,17 +136,15 @@ func TestParseRepodata(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("%v", tc.subDir), func(t *testing.T) {
-			repodata_json := writeTestdataToTmpfile(t, filepath.Join(tc.subDir, "repodata.json"))
-			filtered, fileNames, packageNames, err := ParseRepodata("testdata", repodata_json, nil)
-			if err != nil {
-				t.Fatalf("Unexpected error: %s", err)
-			}
+			repodata := loadTestdataRepodata(t, filepath.Join(tc.subDir, "repodata.json"))
+			filtered, fileNames, packageNames, exclusions := FilterRepodata("testdata", repodata, nil)
 
 			assert.ElementsMatch(t, *tc.expectedFileNames, *fileNames.Items())
 			assert.ElementsMatch(t, *tc.expectedPackageNames, *packageNames.Items())
 
 			assert.Equal(t, tc.expectedLenPackages, len(filtered.Packages))
 			assert.Equal(t, tc.expectedLenPackagesConda, len(filtered.PackagesConda))
+			assert.Empty(t, exclusions)
 		},
 		)
 	}
@@ -199,21 +187,33 @@ func TestFilterRepodataByAllowed(t *testing.T) {
 	assert.Equal(t, 2, len(repodata.Packages))
 	assert.Equal(t, 2, len(repodata.PackagesConda))
 	testCases := []struct {
-		allowed           *Set
+		allowed           *PackageList
+		denied            *PackageList
 		expectedFilenames *[]string
 	}{
 		{
-			NewSet(&[]string{"a", "d"}),
+			newTestPackageList(t, "a", "d"),
+			nil,
 			&[]string{
 				"a-1-0.tar.bz2",
 				"d-4-0.conda",
 			},
 		},
 		{
-			NewSet(&[]string{}),
+			newTestPackageList(t, "a", "b <2", "c >=3", "d 4 1"),
+			nil,
+			&[]string{
+				"a-1-0.tar.bz2",
+				"c-3-0.conda",
+			},
+		},
+		{
+			NewPackageList(),
+			nil,
 			&[]string{},
 		},
 		{
+			nil,
 			nil,
 			&[]string{
 				"a-1-0.tar.bz2",
@@ -222,12 +222,32 @@ func TestFilterRepodataByAllowed(t *testing.T) {
 				"d-4-0.conda",
 			},
 		},
+		{
+			newTestPackageList(t, "a", "d"),
+			newTestPackageList(t, "a"),
+			&[]string{
+				"d-4-0.conda",
+			},
+		},
+		{
+			nil,
+			newTestPackageList(t, "b", "c >=3", "d <4"),
+			&[]string{
+				"a-1-0.tar.bz2",
+				"d-4-0.conda",
+			},
+		},
 	}
 
 	for _, tc := range testCases {
-		t.Run(fmt.Sprintf("%v", tc.allowed), func(t *testing.T) {
-			filtered := FilterRepodataByAllowed(repodata, tc.allowed)
+		t.Run(fmt.Sprintf("%v,%v", tc.allowed, tc.denied), func(t *testing.T) {
+			filtered, _ := FilterRepodataByAllowed(repodata, &FilterPolicy{Allowed: tc.allowed, Denied: tc.denied})
 			assert.Equal(t, len(*tc.expectedFilenames), len(filtered.Packages)+len(filtered.PackagesConda))
+			for _, filename := range *tc.expectedFilenames {
+				_, inPackages := filtered.Packages[filename]
+				_, inPackagesConda := filtered.PackagesConda[filename]
+				assert.True(t, inPackages || inPackagesConda, filename)
+			}
 		})
 	}
 }
@@ -238,91 +258,122 @@ func TestParseListFromFile(t *testing.T) {
 	assert.ElementsMatch(t, []string{"bar", "baz", "foo"}, *allowed.Items())
 }
 
-func TestParseDependencyName(t *testing.T) {
-	testCases := []string{
-		"python >=3.10,<3.11",
-		"python>=3.9,<3.10",
-		"python 3.10",
-		"python",
-		"python=3.8",
-		"python<3.11",
-	}
-	for _, tc := range testCases {
-		t.Run(fmt.Sprintf("%v", tc), func(t *testing.T) {
-			assert.Equal(t, "python", parseDependencyName(tc))
-		})
+func TestFilterRepodataByAllowedExclusions(t *testing.T) {
+	repodata := &Repodata{
+		RepodataVersion: 1,
+		Info:            RepodataInfo{Subdir: "noarch"},
+		Packages: map[string]RepodataRecord{
+			"a-1-0.tar.bz2": {Subdir: "noarch", Name: "a", Version: "1", Build: "0"},
+			"b-1-0.tar.bz2": {Subdir: "noarch", Name: "b", Version: "1", Build: "0"},
+		},
+		PackagesConda: map[string]RepodataRecord{
+			"c-1-0.conda": {Subdir: "noarch", Name: "c", Version: "1", Build: "0"},
+			"d-1-0.conda": {Subdir: "noarch", Name: "d", Version: "2", Build: "0"},
+		},
 	}
-}
-
-func TestUpdateDependencyMap(t *testing.T) {
-	dependencyMap := make(map[string]Set)
 
-	{
-		repodataNoarch := loadTestdataRepodata(t, "noarch/repodata.json")
-		UpdateDependencyMap(&dependencyMap, repodataNoarch)
-
-		assert.Equal(t, 3, len(dependencyMap))
+	filtered, exclusions := FilterRepodataByAllowed(repodata, &FilterPolicy{
+		Allowed: newTestPackageList(t, "b", "c", "d"),
+		Denied:  newTestPackageList(t, "c"),
+	})
 
-		aDeps := dependencyMap["a"]
-		assert.ElementsMatch(t, []string{"b", "c", "d"}, *aDeps.Items())
+	assert.Equal(t, 1, len(filtered.Packages))
+	assert.Contains(t, filtered.Packages, "b-1-0.tar.bz2")
+	assert.Equal(t, 0, len(filtered.PackagesConda))
 
-		bDeps := dependencyMap["b"]
-		assert.Equal(t, []string{"c"}, *bDeps.Items())
+	// Packages that aren't allowed aren't included in exclusions
+	assert.ElementsMatch(t, []Exclusion{
+		{"c-1-0.conda", repodata.PackagesConda["c-1-0.conda"], RuleDenied, "c"},
+		{"d-1-0.conda", repodata.PackagesConda["d-1-0.conda"], RuleInvalidFilename, "filename does not match metadata: d-1-0.conda != d-2-0.conda"},
+	}, exclusions)
+}
 
-		cDeps := dependencyMap["c"]
-		assert.Equal(t, []string{}, *cDeps.Items())
+func TestParsePackageFilename(t *testing.T) {
+	testCases := []struct {
+		filename string
+		expected []string
+	}{
+		{"numpy-1.25.2-py311h64a7726_0.conda", []string{"numpy", "1.25.2", "py311h64a7726_0"}},
+		{"ca-certificates-2023.7.22-hbcca054_0.tar.bz2", []string{"ca-certificates", "2023.7.22", "hbcca054_0"}},
+		{"numpy-1.25.2.conda", nil},
+		{"numpy-1.25.2-0.whl", nil},
+		{"-1-0.conda", nil},
 	}
+	for _, tc := range testCases {
+		t.Run(tc.filename, func(t *testing.T) {
+			name, version, build, ok := ParsePackageFilename(tc.filename)
+			assert.Equal(t, tc.expected != nil, ok)
+			if tc.expected != nil {
+				assert.Equal(t, tc.expected, []string{name, version, build})
+			}
+		})
+	}
+}
 
-	{
-		repodataLinux := loadTestdataRepodata(t, "linux-64/repodata.json")
-		UpdateDependencyMap(&dependencyMap, repodataLinux)
-
-		assert.Equal(t, 5, len(dependencyMap))
-
-		aDeps := dependencyMap["a"]
-		assert.ElementsMatch(t, []string{"b", "c", "d"}, *aDeps.Items())
-
-		bDeps := dependencyMap["b"]
-		assert.Equal(t, []string{"c"}, *bDeps.Items())
-
-		cDeps := dependencyMap["c"]
-		assert.Equal(t, []string{}, *cDeps.Items())
+func TestFilterRepodataByAllowedRemoved(t *testing.T) {
+	repodata := &Repodata{
+		RepodataVersion: 1,
+		Info:            RepodataInfo{Subdir: "noarch", Extra: map[string]interface{}{"base_url": "https://example.org"}},
+		Packages:        map[string]RepodataRecord{},
+		PackagesConda:   map[string]RepodataRecord{},
+		Removed:         []string{"a-1-0.tar.bz2", "b-1-0.conda", "b-2-0.conda", "c-1-0.conda", "d-1-0.conda", "e-1-0.conda", "invalid"},
+		Extra:           map[string]interface{}{"future_field": "x"},
+	}
 
-		dDeps := dependencyMap["d"]
-		assert.Equal(t, []string{"c"}, *dDeps.Items())
+	filtered, _ := FilterRepodataByAllowed(repodata, nil)
+	assert.Equal(t, repodata.Removed, filtered.Removed)
+	assert.Equal(t, repodata.Info, filtered.Info)
+	assert.Equal(t, repodata.Extra, filtered.Extra)
 
-		eDeps := dependencyMap["e"]
-		assert.Equal(t, []string{}, *eDeps.Items())
-	}
+	filtered, _ = FilterRepodataByAllowed(repodata, &FilterPolicy{
+		Allowed: newTestPackageList(t, "a", "b >=2"),
+		// d is in the dependency closure, e is only a dependency in another subdir
+		AllowedFiles: NewSet(&[]string{"noarch/c-1-0.conda", "noarch/d-2-0.conda", "linux-64/e-2-0.conda"}),
+	})
+	assert.Equal(t, []string{"a-1-0.tar.bz2", "b-2-0.conda", "c-1-0.conda", "d-1-0.conda"}, filtered.Removed)
 }
 
-func TestGetChannelPackageDependencies(t *testing.T) {
-	dependencyMap := map[string]Set{
-		"a": *NewSet(&[]string{"b", "c", "d"}),
-		"b": *NewSet(&[]string{"c"}),
-		"c": *NewSet(nil),
-		"d": *NewSet(&[]string{"c"}),
-		"e": *NewSet(nil),
+func TestFilterRepodataByAllowedPreferConda(t *testing.T) {
+	record := func(name string) RepodataRecord {
+		return RepodataRecord{Subdir: "noarch", Name: name, Version: "1", Build: "0"}
 	}
-
-	testCases := []struct {
-		allowedPackages *[]string
-		expectedNames   *[]string
-	}{
-		{&[]string{"a"}, &[]string{"a", "b", "c", "d"}},
-		{&[]string{"b"}, &[]string{"b", "c"}},
-		{&[]string{"c"}, &[]string{"c"}},
-		{&[]string{"d"}, &[]string{"c", "d"}},
-		{&[]string{"e"}, &[]string{"e"}},
-
-		{&[]string{"b", "e"}, &[]string{"b", "c", "e"}},
-		{&[]string{"b", "e", "a"}, &[]string{"a", "b", "c", "d", "e"}},
+	repodata := &Repodata{
+		Info: RepodataInfo{Subdir: "noarch"},
+		Packages: map[string]RepodataRecord{
+			"a-1-0.tar.bz2": record("a"),
+			"b-1-0.tar.bz2": record("b"),
+			"c-1-0.tar.bz2": record("c"),
+			"d-1-0.tar.bz2": record("d"),
+		},
+		PackagesConda: map[string]RepodataRecord{
+			"a-1-0.conda": record("a"),
+			"c-1-0.conda": record("c"),
+			"d-1-0.conda": record("d"),
+		},
 	}
 
-	for _, tc := range testCases {
-		t.Run(fmt.Sprintf("%v", tc.allowedPackages), func(t *testing.T) {
-			names := GetChannelPackageDependencies(dependencyMap, NewSet(tc.allowedPackages))
-			assert.ElementsMatch(t, *tc.expectedNames, *names.Items())
-		})
-	}
+	filtered, exclusions := FilterRepodataByAllowed(repodata, &FilterPolicy{})
+	assert.Equal(t, 4, len(filtered.Packages))
+	assert.Equal(t, 0, len(exclusions))
+
+	filtered, exclusions = FilterRepodataByAllowed(repodata, &FilterPolicy{
+		Denied:      newTestPackageList(t, "d"),
+		LockedFiles: NewSet(&[]string{"noarch/c-1-0.tar.bz2"}),
+		PreferConda: true,
+	})
+	assert.Equal(t, map[string]RepodataRecord{
+		"b-1-0.tar.bz2": record("b"),
+		"c-1-0.tar.bz2": record("c"),
+	}, filtered.Packages)
+	assert.Equal(t, map[string]RepodataRecord{
+		"a-1-0.conda": record("a"),
+		"c-1-0.conda": record("c"),
+	}, filtered.PackagesConda)
+
+	sort.Slice(exclusions, func(i, j int) bool { return exclusions[i].Filename < exclusions[j].Filename })
+	assert.Equal(t, []Exclusion{
+		{"a-1-0.tar.bz2", record("a"), RulePreferConda, "available as a-1-0.conda"},
+		{"d-1-0.conda", record("d"), RuleDenied, "d"},
+		{"d-1-0.tar.bz2", record("d"), RuleDenied, "d"},
+	}, exclusions)
 }
@@ -0,0 +1,257 @@
+// Incremental repodata updates, repodata.jlap
+// https://github.com/conda/ceps/blob/main/cep-0016.md
+package repodata
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// JLAPPatch is a JSON Patch from one version of repodata.json to the next,
+// versions are identified by their BLAKE2b-256 hash
+type JLAPPatch struct {
+	To    string               `json:"to"`
+	From  string               `json:"from"`
+	Patch []JSONPatchOperation `json:"patch"`
+}
+
+// JLAPMetadata is the second to last line of a JLAP file
+type JLAPMetadata struct {
+	URL string `json:"url"`
+	// Hash of the latest repodata.json
+	Latest string `json:"latest"`
+}
+
+// JLAP is a repodata.jlap file
+//
+// The first line is an initialisation vector, followed by one line per patch,
+// the metadata, and a checksum. Each line's checksum is the BLAKE2b-256 hash of
+// the line keyed with the previous line's checksum, the first line's checksum
+// is the initialisation vector.
+type JLAP struct {
+	// Initialisation vector, hex
+	IV       string
+	Patches  []JLAPPatch
+	Metadata JLAPMetadata
+}
+
+// NewBlake2b256 returns a BLAKE2b-256 hash, as used to identify repodata.json versions
+func NewBlake2b256() hash.Hash {
+	// Only fails if the key is too long
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+// Blake2b256 returns the hex BLAKE2b-256 hash of data
+func Blake2b256(data []byte) string {
+	sum := blake2b.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// jlapChecksum returns the checksum of a line keyed by the previous checksum
+func jlapChecksum(line []byte, previous []byte) ([]byte, error) {
+	h, err := blake2b.New256(previous)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(line)
+	return h.Sum(nil), nil
+}
+
+// jlapTail is the position of the metadata line of a JLAP file, new patches
+// are inserted here so it's where an incremental download starts
+type jlapTail struct {
+	Offset int64
+	// Checksum of the line before the metadata, hex
+	Checksum string
+}
+
+// ParseJLAP parses and verifies a JLAP file
+func ParseJLAP(data []byte) (*JLAP, error) {
+	j, _, err := parseJLAP(data)
+	return j, err
+}
+
+// parseJLAP parses and verifies a JLAP file, and returns the position of the
+// metadata line
+func parseJLAP(data []byte) (*JLAP, *jlapTail, error) {
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) < 3 {
+		return nil, nil, errors.New("invalid jlap: expected at least 3 lines")
+	}
+
+	checksum, err := hex.DecodeString(lines[0])
+	if err != nil || len(checksum) != blake2b.Size256 {
+		return nil, nil, errors.New("invalid jlap initialisation vector: " + lines[0])
+	}
+	tail := &jlapTail{Offset: int64(len(lines[0]) + 1), Checksum: lines[0]}
+	for i, line := range lines[1 : len(lines)-1] {
+		if checksum, err = jlapChecksum([]byte(line), checksum); err != nil {
+			return nil, nil, err
+		}
+		if i < len(lines)-3 {
+			tail.Offset += int64(len(line) + 1)
+			tail.Checksum = hex.EncodeToString(checksum)
+		}
+	}
+	if expected := lines[len(lines)-1]; hex.EncodeToString(checksum) != expected {
+		return nil, nil, fmt.Errorf("jlap checksum mismatch: %s != %s", hex.EncodeToString(checksum), expected)
+	}
+
+	j := &JLAP{IV: lines[0], Patches: []JLAPPatch{}}
+	for i, line := range lines[1 : len(lines)-2] {
+		var patch JLAPPatch
+		if err := json.Unmarshal([]byte(line), &patch); err != nil {
+			return nil, nil, fmt.Errorf("invalid jlap patch on line %d: %s", i+2, err)
+		}
+		j.Patches = append(j.Patches, patch)
+	}
+	if err := json.Unmarshal([]byte(lines[len(lines)-2]), &j.Metadata); err != nil {
+		return nil, nil, fmt.Errorf("invalid jlap metadata: %s", err)
+	}
+	return j, tail, nil
+}
+
+// Bytes encodes the JLAP file, including the checksum
+func (j *JLAP) Bytes() ([]byte, error) {
+	checksum, err := hex.DecodeString(j.IV)
+	if err != nil || len(checksum) != blake2b.Size256 {
+		return nil, errors.New("invalid jlap initialisation vector: " + j.IV)
+	}
+	lines := []string{j.IV}
+	add := func(v interface{}) error {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if checksum, err = jlapChecksum(line, checksum); err != nil {
+			return err
+		}
+		lines = append(lines, string(line))
+		return nil
+	}
+	for _, patch := range j.Patches {
+		if err := add(patch); err != nil {
+			return nil, err
+		}
+	}
+	if err := add(j.Metadata); err != nil {
+		return nil, err
+	}
+	lines = append(lines, hex.EncodeToString(checksum))
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// PatchesFrom returns the patches that update the repodata.json version with
+// hash from to the latest version, in order
+func (j *JLAP) PatchesFrom(from string) ([]JLAPPatch, error) {
+	patches := make(map[string]JLAPPatch)
+	for _, patch := range j.Patches {
+		patches[patch.From] = patch
+	}
+	chain := []JLAPPatch{}
+	for from != j.Metadata.Latest {
+		patch, ok := patches[from]
+		if !ok || len(chain) == len(j.Patches) {
+			return nil, errors.New("no jlap patch from " + from)
+		}
+		chain = append(chain, patch)
+		from = patch.To
+	}
+	return chain, nil
+}
+
+// ApplyJLAPPatches applies patches to a JSON document
+func ApplyJLAPPatches(data []byte, patches []JLAPPatch) ([]byte, error) {
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, patch := range patches {
+		if doc, err = ApplyJSONPatch(doc, patch.Patch); err != nil {
+			return nil, fmt.Errorf("jlap patch to %s: %s", patch.To, err)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// Trim drops the oldest patches so at most n remain
+//
+// The initialisation vector is replaced by the checksum of the last dropped
+// line, so the checksums of the remaining lines don't change.
+func (j *JLAP) Trim(n int) error {
+	if len(j.Patches) <= n {
+		return nil
+	}
+	checksum, err := hex.DecodeString(j.IV)
+	if err != nil || len(checksum) != blake2b.Size256 {
+		return errors.New("invalid jlap initialisation vector: " + j.IV)
+	}
+	dropped := len(j.Patches) - n
+	for _, patch := range j.Patches[:dropped] {
+		line, err := json.Marshal(patch)
+		if err != nil {
+			return err
+		}
+		if checksum, err = jlapChecksum(line, checksum); err != nil {
+			return err
+		}
+	}
+	j.IV = hex.EncodeToString(checksum)
+	j.Patches = j.Patches[dropped:]
+	return nil
+}
+
+// UpdateJLAPFile adds a patch from the previous to the current version of a
+// repodata.json to the JLAP file filename, keeping at least maxPatches patches
+//
+// Clients download the lines added since their last update with a Range
+// request, so the file is only trimmed in batches: once it has more than
+// 2*maxPatches patches the oldest are dropped so maxPatches remain. Between
+// trims patches are only appended, and the offset of the metadata line from a
+// previous download is still valid.
+//
+// previous is nil if there's no previous version. If the JLAP file doesn't
+// exist, is invalid, or doesn't end at the previous version it's replaced.
+func UpdateJLAPFile(filename string, previous []byte, current []byte, maxPatches int) error {
+	latest := Blake2b256(current)
+	var j *JLAP
+	if previous != nil {
+		if data, err := os.ReadFile(filename); err == nil {
+			if j, err = ParseJLAP(data); err == nil && j.Metadata.Latest != Blake2b256(previous) {
+				j = nil
+			}
+		}
+	}
+	if j == nil {
+		j = &JLAP{IV: strings.Repeat("0", 2*blake2b.Size256), Patches: []JLAPPatch{}}
+	}
+
+	if previous != nil && j.Metadata.Latest != latest {
+		patch, err := DiffJSON(previous, current)
+		if err != nil {
+			return err
+		}
+		j.Patches = append(j.Patches, JLAPPatch{To: latest, From: Blake2b256(previous), Patch: patch})
+	}
+	j.Metadata = JLAPMetadata{URL: "repodata.json", Latest: latest}
+	if len(j.Patches) > 2*maxPatches {
+		if err := j.Trim(maxPatches); err != nil {
+			return err
+		}
+	}
+
+	data, err := j.Bytes()
+	if err != nil {
+		return err
+	}
+	return WriteTempAndRename(bytes.NewReader(data), filename)
+}
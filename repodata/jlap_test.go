@@ -0,0 +1,446 @@
+package repodata
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	jlapV1 = "b62323a7f6c7c0961b53f43e90b7dc8b748be4c699a4dc5360fb5a7cd663c108"
+	jlapV2 = "4fe6b00eb633707b5dba209579dd35e0ccd7e68b04898575acbbd7fbb3c7bdfb"
+	jlapV3 = "a49e4fda8e25c66664340988e65b2834b7fe21dae4849da458b7091ddf86376f"
+)
+
+func TestBlake2b256(t *testing.T) {
+	assert.Equal(t, "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8", Blake2b256([]byte{}))
+
+	data, err := os.ReadFile("testdata/jlap/repodata-v1.json")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, jlapV1, Blake2b256(data))
+	h := NewBlake2b256()
+	h.Write(data)
+	assert.Equal(t, jlapV1, hex.EncodeToString(h.Sum(nil)))
+}
+
+func TestParseJLAP(t *testing.T) {
+	data, err := os.ReadFile("testdata/jlap/repodata.jlap")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	j, err := ParseJLAP(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	assert.Equal(t, strings.Repeat("0", 64), j.IV)
+	assert.Equal(t, JLAPMetadata{URL: "repodata.json", Latest: jlapV3}, j.Metadata)
+	assert.Equal(t, 2, len(j.Patches))
+	assert.Equal(t, jlapV1, j.Patches[0].From)
+	assert.Equal(t, jlapV2, j.Patches[0].To)
+	assert.Equal(t, []JSONPatchOperation{{Op: "remove", Path: "/packages/a-1-0.tar.bz2"}}, j.Patches[1].Patch)
+
+	// Trailing newlines are allowed
+	_, err = ParseJLAP(append(data, '\n'))
+	assert.NoError(t, err)
+
+	// Bytes writes compact JSON with a new valid checksum
+	encoded, err := j.Bytes()
+	assert.NoError(t, err)
+	reparsed, err := ParseJLAP(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, j.Metadata, reparsed.Metadata)
+	assert.Equal(t, json.RawMessage(`{"name":"b"}`), reparsed.Patches[0].Patch[0].Value)
+	reencoded, err := reparsed.Bytes()
+	assert.NoError(t, err)
+	assert.Equal(t, string(encoded), string(reencoded))
+}
+
+func TestParseJLAPInvalid(t *testing.T) {
+	data, err := os.ReadFile("testdata/jlap/repodata.jlap")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	_, err = ParseJLAP([]byte(strings.Replace(string(data), `"name": "b"`, `"name": "c"`, 1)))
+	assert.ErrorContains(t, err, "jlap checksum mismatch: ")
+
+	_, err = ParseJLAP([]byte("0000\n{}\n0000"))
+	assert.EqualError(t, err, "invalid jlap initialisation vector: 0000")
+
+	_, err = ParseJLAP([]byte(strings.Repeat("0", 64) + "\n{}"))
+	assert.EqualError(t, err, "invalid jlap: expected at least 3 lines")
+
+	_, err = (&JLAP{IV: "x"}).Bytes()
+	assert.EqualError(t, err, "invalid jlap initialisation vector: x")
+}
+
+func TestJLAPPatchesFrom(t *testing.T) {
+	j := &JLAP{
+		Patches: []JLAPPatch{
+			{From: "a", To: "b"},
+			{From: "b", To: "c"},
+			{From: "c", To: "d"},
+			{From: "x", To: "y"},
+			{From: "y", To: "x"},
+		},
+		Metadata: JLAPMetadata{Latest: "d"},
+	}
+
+	patches, err := j.PatchesFrom("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []JLAPPatch{{From: "b", To: "c"}, {From: "c", To: "d"}}, patches)
+
+	patches, err = j.PatchesFrom("d")
+	assert.NoError(t, err)
+	assert.Equal(t, []JLAPPatch{}, patches)
+
+	_, err = j.PatchesFrom("z")
+	assert.EqualError(t, err, "no jlap patch from z")
+
+	_, err = j.PatchesFrom("x")
+	assert.Error(t, err)
+}
+
+func TestApplyJLAPPatches(t *testing.T) {
+	data, err := os.ReadFile("testdata/jlap/repodata.jlap")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	j, err := ParseJLAP(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	updated, err := ApplyJLAPPatches([]byte(`{"info":{"subdir":"noarch"},"packages":{"a-1-0.tar.bz2":{"name":"a"}}}`), j.Patches)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"info":{"subdir":"noarch"},"packages":{"b-1-0.tar.bz2":{"name":"b"}}}`, string(updated))
+
+	_, err = ApplyJLAPPatches([]byte(`{"info":{"subdir":"noarch"},"packages":{}}`), j.Patches[1:])
+	assert.EqualError(t, err, "jlap patch to "+jlapV3+": remove /packages/a-1-0.tar.bz2: missing key: a-1-0.tar.bz2")
+}
+
+func TestUpdateRepodataDownloadJLAP(t *testing.T) {
+	v1, err := os.ReadFile("testdata/jlap/repodata-v1.json")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	jlap, err := os.ReadFile("testdata/jlap/repodata.jlap")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		var body []byte
+		switch r.URL.Path {
+		case "/channel/noarch/repodata.json":
+			body = v1
+		case "/channel/noarch/repodata.jlap":
+			body = jlap
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write(body); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	url := server.URL + "/channel/noarch/repodata.json"
+	destination := filepath.Join(t.TempDir(), "repodata.json")
+
+	// Full download, the hash of the cached file is stored
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+	assert.Equal(t, []string{"/channel/noarch/repodata.json.zst", "/channel/noarch/repodata.json"}, requests)
+	m, err := LoadCacheMetadata(destination)
+	assert.NoError(t, err)
+	assert.Equal(t, jlapV1, m.Blake2b)
+
+	// Patched to the latest version
+	requests = []string{}
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+	assert.Equal(t, []string{"/channel/noarch/repodata.jlap"}, requests)
+	contents, _ := os.ReadFile(destination)
+	assert.Equal(t, `{"info":{"subdir":"noarch"},"packages":{"b-1-0.tar.bz2":{"name":"b"}}}`, string(contents))
+	m, err = LoadCacheMetadata(destination)
+	assert.NoError(t, err)
+	lines := strings.Split(string(jlap), "\n")
+	assert.Equal(t, &CacheMetadata{
+		URL:          url,
+		Blake2b:      jlapV3,
+		JLAPOffset:   int64(strings.Index(string(jlap), `{"url"`)),
+		JLAPChecksum: jlapLineChecksum(t, lines[:3]),
+	}, m)
+
+	// Already the latest version
+	requests = []string{}
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+	assert.Equal(t, []string{"/channel/noarch/repodata.jlap"}, requests)
+
+	// Forced, the jlap is ignored
+	requests = []string{}
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 1440, true))
+	assert.Equal(t, []string{"/channel/noarch/repodata.json.zst", "/channel/noarch/repodata.json"}, requests)
+	contents, _ = os.ReadFile(destination)
+	assert.Equal(t, v1, contents)
+	m, err = LoadCacheMetadata(destination)
+	assert.NoError(t, err)
+	assert.Equal(t, jlapV1, m.Blake2b)
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+
+	// Invalid jlap, falls back to a full download
+	jlap = []byte(strings.Replace(string(jlap), `"name": "b"`, `"name": "c"`, 1))
+	requests = []string{}
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+	assert.Equal(t, []string{"/channel/noarch/repodata.jlap", "/channel/noarch/repodata.json.zst", "/channel/noarch/repodata.json"}, requests)
+	contents, _ = os.ReadFile(destination)
+	assert.Equal(t, v1, contents)
+}
+
+// jlapLineChecksum returns the checksum of the last line in lines
+func jlapLineChecksum(t *testing.T, lines []string) string {
+	checksum, err := hex.DecodeString(lines[0])
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, line := range lines[1:] {
+		if checksum, err = jlapChecksum([]byte(line), checksum); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	return hex.EncodeToString(checksum)
+}
+
+func TestUpdateRepodataDownloadJLAPRange(t *testing.T) {
+	v1, err := os.ReadFile("testdata/jlap/repodata-v1.json")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	data, err := os.ReadFile("testdata/jlap/repodata.jlap")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	j, err := ParseJLAP(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	encode := func(j *JLAP) []byte {
+		encoded, err := j.Bytes()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return encoded
+	}
+	// The first version only has the patch to v2, the second version appends
+	// the patch to v3
+	jlapV3Bytes := encode(j)
+	jlapV2Bytes := encode(&JLAP{IV: j.IV, Patches: j.Patches[:1], Metadata: JLAPMetadata{URL: "repodata.json", Latest: jlapV2}})
+	jlap := jlapV2Bytes
+
+	type request struct {
+		path   string
+		status int
+		rng    string
+		length int
+	}
+	requests := []request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recordingWriter{ResponseWriter: w}
+		switch r.URL.Path {
+		case "/channel/noarch/repodata.json":
+			http.ServeContent(rw, r, "repodata.json", time.Time{}, bytes.NewReader(v1))
+		case "/channel/noarch/repodata.jlap":
+			w.Header().Set("ETag", `"`+Blake2b256(jlap)+`"`)
+			http.ServeContent(rw, r, "repodata.jlap", time.Time{}, bytes.NewReader(jlap))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+		requests = append(requests, request{r.URL.Path, rw.status, r.Header.Get("Range"), rw.length})
+	}))
+	defer server.Close()
+
+	url := server.URL + "/channel/noarch/repodata.json"
+	destination := filepath.Join(t.TempDir(), "repodata.json")
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+
+	// The first jlap download is complete
+	requests = []request{}
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+	assert.Equal(t, []request{{"/channel/noarch/repodata.jlap", http.StatusOK, "", len(jlapV2Bytes)}}, requests)
+	m, err := LoadCacheMetadata(destination)
+	assert.NoError(t, err)
+	assert.Equal(t, jlapV2, m.Blake2b)
+	offset := strings.Index(string(jlapV2Bytes), `{"url"`)
+	assert.Equal(t, int64(offset), m.JLAPOffset)
+
+	// Only the new lines are downloaded
+	jlap = jlapV3Bytes
+	requests = []request{}
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+	assert.Equal(t, []request{{"/channel/noarch/repodata.jlap", http.StatusPartialContent, fmt.Sprintf("bytes=%d-", offset), len(jlapV3Bytes) - offset}}, requests)
+	contents, _ := os.ReadFile(destination)
+	assert.Equal(t, `{"info":{"subdir":"noarch"},"packages":{"b-1-0.tar.bz2":{"name":"b"}}}`, string(contents))
+	m, err = LoadCacheMetadata(destination)
+	assert.NoError(t, err)
+	assert.Equal(t, jlapV3, m.Blake2b)
+	offset = strings.Index(string(jlapV3Bytes), `{"url"`)
+	assert.Equal(t, int64(offset), m.JLAPOffset)
+	assert.Equal(t, `"`+Blake2b256(jlapV3Bytes)+`"`, m.JLAPETag)
+
+	// Unchanged
+	requests = []request{}
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+	assert.Equal(t, []request{{"/channel/noarch/repodata.jlap", http.StatusNotModified, fmt.Sprintf("bytes=%d-", offset), 0}}, requests)
+
+	// Rewritten, the new lines can't be verified so all of it is downloaded
+	jlap = encode(&JLAP{IV: strings.Repeat("1", 64), Patches: j.Patches, Metadata: j.Metadata})
+	requests = []request{}
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+	assert.Equal(t, []request{
+		{"/channel/noarch/repodata.jlap", http.StatusPartialContent, fmt.Sprintf("bytes=%d-", offset), len(jlap) - offset},
+		{"/channel/noarch/repodata.jlap", http.StatusOK, "", len(jlap)},
+	}, requests)
+	m, err = LoadCacheMetadata(destination)
+	assert.NoError(t, err)
+	assert.Equal(t, jlapV3, m.Blake2b)
+	assert.Equal(t, int64(strings.Index(string(jlap), `{"url"`)), m.JLAPOffset)
+
+	// Trimmed to less than the offset
+	assert.NoError(t, j.Trim(1))
+	jlap = encode(j)
+	requests = []request{}
+	assert.NoError(t, UpdateRepodataDownload(url, destination, 0, false))
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, requests[0].status)
+	assert.Equal(t, request{"/channel/noarch/repodata.jlap", http.StatusOK, "", len(jlap)}, requests[1])
+}
+
+// recordingWriter records the status and length of a response
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	length int
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.length += n
+	return n, err
+}
+
+func TestJLAPTrim(t *testing.T) {
+	data, err := os.ReadFile("testdata/jlap/repodata.jlap")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	j, err := ParseJLAP(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	encoded, err := j.Bytes()
+	assert.NoError(t, err)
+
+	assert.NoError(t, j.Trim(2))
+	assert.Equal(t, 2, len(j.Patches))
+
+	// The remaining lines and checksum are unchanged
+	assert.NoError(t, j.Trim(1))
+	assert.Equal(t, jlapV2, j.Patches[0].From)
+	trimmed, err := j.Bytes()
+	assert.NoError(t, err)
+	encodedLines := strings.Split(string(encoded), "\n")
+	trimmedLines := strings.Split(string(trimmed), "\n")
+	assert.Equal(t, encodedLines[2:], trimmedLines[1:])
+	assert.NotEqual(t, encodedLines[0], trimmedLines[0])
+
+	assert.NoError(t, j.Trim(0))
+	assert.Equal(t, []JLAPPatch{}, j.Patches)
+}
+
+func TestUpdateJLAPFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "repodata.jlap")
+	v1 := []byte(`{"info":{"subdir":"noarch"},"packages":{"a-1-0.tar.bz2":{"name":"a"}}}`)
+	v2 := []byte(`{"info":{"subdir":"noarch"},"packages":{"a-1-0.tar.bz2":{"name":"a"},"b-1-0.tar.bz2":{"name":"b"}}}`)
+	v3 := []byte(`{"info":{"subdir":"noarch"},"packages":{"b-1-0.tar.bz2":{"name":"b"}}}`)
+
+	load := func() *JLAP {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		j, err := ParseJLAP(data)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return j
+	}
+
+	// No previous version
+	assert.NoError(t, UpdateJLAPFile(filename, nil, v1, 2))
+	j := load()
+	assert.Equal(t, []JLAPPatch{}, j.Patches)
+	assert.Equal(t, JLAPMetadata{URL: "repodata.json", Latest: Blake2b256(v1)}, j.Metadata)
+
+	// Unchanged
+	assert.NoError(t, UpdateJLAPFile(filename, v1, v1, 2))
+	assert.Equal(t, 0, len(load().Patches))
+
+	assert.NoError(t, UpdateJLAPFile(filename, v1, v2, 2))
+	assert.NoError(t, UpdateJLAPFile(filename, v2, v3, 2))
+	j = load()
+	assert.Equal(t, Blake2b256(v3), j.Metadata.Latest)
+	patches, err := j.PatchesFrom(Blake2b256(v1))
+	assert.NoError(t, err)
+	patched, err := ApplyJLAPPatches(v1, patches)
+	assert.NoError(t, err)
+	assert.Equal(t, string(v3), string(patched))
+
+	// Patches are appended, the lines before the metadata are unchanged
+	before, _ := os.ReadFile(filename)
+	_, tail, err := parseJLAP(before)
+	assert.NoError(t, err)
+	assert.NoError(t, UpdateJLAPFile(filename, v3, v1, 2))
+	after, _ := os.ReadFile(filename)
+	assert.Equal(t, string(before[:tail.Offset]), string(after[:tail.Offset]))
+	assert.Equal(t, 3, len(load().Patches))
+	assert.NoError(t, UpdateJLAPFile(filename, v1, v2, 2))
+	assert.Equal(t, 4, len(load().Patches))
+
+	// Trimmed to the latest patches once there are more than twice as many
+	assert.NoError(t, UpdateJLAPFile(filename, v2, v3, 2))
+	j = load()
+	assert.Equal(t, 2, len(j.Patches))
+	assert.Equal(t, Blake2b256(v1), j.Patches[0].From)
+	assert.NotEqual(t, strings.Repeat("0", 64), j.IV)
+	assert.NoError(t, UpdateJLAPFile(filename, v3, v1, 2))
+	assert.Equal(t, 3, len(load().Patches))
+
+	// The previous version doesn't match the jlap, start again
+	assert.NoError(t, UpdateJLAPFile(filename, v2, v3, 2))
+	j = load()
+	assert.Equal(t, strings.Repeat("0", 64), j.IV)
+	assert.Equal(t, 1, len(j.Patches))
+	assert.Equal(t, Blake2b256(v2), j.Patches[0].From)
+}
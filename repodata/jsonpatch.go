@@ -0,0 +1,345 @@
+// JSON Patch
+// https://datatracker.ietf.org/doc/html/rfc6902
+package repodata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSONPatchOperation is a single JSON Patch operation
+type JSONPatchOperation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Source path for move and copy
+	From string `json:"from,omitempty"`
+	// Value for add, replace and test
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// decodeJSON decodes JSON, numbers are decoded as json.Number so they're unchanged
+// when encoded
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// parseJSONPointer splits a JSON Pointer into unescaped reference tokens
+// https://datatracker.ietf.org/doc/html/rfc6901
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if pointer[0] != '/' {
+		return nil, errors.New("invalid JSON pointer: " + pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index, if end is true "-" and len(array) are allowed
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (i == length && !end) || (len(token) > 1 && token[0] == '0') {
+		return 0, errors.New("invalid array index: " + token)
+	}
+	return i, nil
+}
+
+// getJSON returns the value referenced by tokens
+func getJSON(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[token]
+			if !ok {
+				return nil, errors.New("missing key: " + token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, errors.New("not an object or array: " + token)
+		}
+	}
+	return doc, nil
+}
+
+// updateJSON calls update with the container of the value referenced by tokens
+// and the last token, and replaces the container with the result
+func updateJSON(doc interface{}, tokens []string, update func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return update(doc, tokens[0])
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[tokens[0]]
+		if !ok {
+			return nil, errors.New("missing key: " + tokens[0])
+		}
+		updated, err := updateJSON(child, tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		d[tokens[0]] = updated
+		return d, nil
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(d), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := updateJSON(d[i], tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		d[i] = updated
+		return d, nil
+	default:
+		return nil, errors.New("not an object or array: " + tokens[0])
+	}
+}
+
+func addJSON(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return updateJSON(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		default:
+			return nil, errors.New("not an object or array: " + token)
+		}
+	})
+}
+
+func removeJSON(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("can't remove the whole document")
+	}
+	return updateJSON(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, errors.New("missing key: " + token)
+			}
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		default:
+			return nil, errors.New("not an object or array: " + token)
+		}
+	})
+}
+
+func replaceJSON(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if _, err := getJSON(doc, tokens); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return updateJSON(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			c[i] = value
+			return c, nil
+		default:
+			return nil, errors.New("not an object or array: " + token)
+		}
+	})
+}
+
+// copyJSON returns a deep copy of a decoded JSON value
+func copyJSON(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(data)
+}
+
+// applyJSONPatchOperation applies a single operation to a decoded JSON document
+func applyJSONPatchOperation(doc interface{}, op JSONPatchOperation) (interface{}, error) {
+	tokens, err := parseJSONPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		if value, err = decodeJSON(op.Value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		from, err := parseJSONPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = getJSON(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			if value, err = copyJSON(value); err != nil {
+				return nil, err
+			}
+		} else {
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, errors.New("can't move a value into itself")
+			}
+			if doc, err = removeJSON(doc, from); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return addJSON(doc, tokens, value)
+	case "remove":
+		return removeJSON(doc, tokens)
+	case "replace":
+		return replaceJSON(doc, tokens, value)
+	case "test":
+		current, err := getJSON(doc, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, errors.New("test failed: " + op.Path)
+		}
+		return doc, nil
+	default:
+		return nil, errors.New("invalid operation: " + op.Op)
+	}
+}
+
+// ApplyJSONPatch applies a JSON Patch to a decoded JSON document
+//
+// The document may be modified, use the returned document.
+func ApplyJSONPatch(doc interface{}, patch []JSONPatchOperation) (interface{}, error) {
+	var err error
+	for _, op := range patch {
+		if doc, err = applyJSONPatchOperation(doc, op); err != nil {
+			return nil, fmt.Errorf("%s %s: %s", op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// escapeJSONPointer escapes a reference token for use in a JSON Pointer
+func escapeJSONPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// diffJSON appends the operations that change a into b to patch
+func diffJSON(patch []JSONPatchOperation, path string, a interface{}, b interface{}) ([]JSONPatchOperation, error) {
+	if reflect.DeepEqual(a, b) {
+		return patch, nil
+	}
+	aMap, aOk := a.(map[string]interface{})
+	bMap, bOk := b.(map[string]interface{})
+	if !aOk || !bOk {
+		// Arrays and scalars are replaced, repodata arrays are short
+		value, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		return append(patch, JSONPatchOperation{Op: "replace", Path: path, Value: value}), nil
+	}
+
+	keys := []string{}
+	for k := range aMap {
+		keys = append(keys, k)
+	}
+	for k := range bMap {
+		if _, ok := aMap[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var err error
+	for _, k := range keys {
+		childPath := path + "/" + escapeJSONPointer(k)
+		aValue, inA := aMap[k]
+		bValue, inB := bMap[k]
+		switch {
+		case !inB:
+			patch = append(patch, JSONPatchOperation{Op: "remove", Path: childPath})
+		case !inA:
+			value, err := json.Marshal(bValue)
+			if err != nil {
+				return nil, err
+			}
+			patch = append(patch, JSONPatchOperation{Op: "add", Path: childPath, Value: value})
+		default:
+			if patch, err = diffJSON(patch, childPath, aValue, bValue); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return patch, nil
+}
+
+// DiffJSON returns a JSON Patch that changes JSON document a into b
+//
+// Objects are compared key by key, any other changed value is replaced.
+func DiffJSON(a []byte, b []byte) ([]JSONPatchOperation, error) {
+	aDoc, err := decodeJSON(a)
+	if err != nil {
+		return nil, err
+	}
+	bDoc, err := decodeJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	return diffJSON([]JSONPatchOperation{}, "", aDoc, bDoc)
+}
@@ -0,0 +1,112 @@
+package repodata
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Examples from https://datatracker.ietf.org/doc/html/rfc6902#appendix-A
+func TestApplyJSONPatch(t *testing.T) {
+	testCases := []struct {
+		name     string
+		doc      string
+		patch    string
+		expected string
+		err      string
+	}{
+		{"add object member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, ""},
+		{"add array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, ""},
+		{"append array element", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`, ""},
+		{"add null", `{"foo":1}`, `[{"op":"add","path":"/bar","value":null}]`, `{"bar":null,"foo":1}`, ""},
+		{"add whole document", `{"foo":1}`, `[{"op":"add","path":"","value":[1]}]`, `[1]`, ""},
+		{"remove object member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, ""},
+		{"remove array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, ""},
+		{"replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, ""},
+		{"move", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, ""},
+		{"move array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, ""},
+		{"copy", `{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`, `{"baz":{"bar":2},"foo":{"bar":1}}`, ""},
+		{"test", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`, ""},
+		{"test failed", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, "", "test /baz: test failed: /baz"},
+		{"escaped keys", `{"/":1,"m~n":2}`, `[{"op":"remove","path":"/~1"},{"op":"replace","path":"/m~0n","value":3}]`, `{"m~n":3}`, ""},
+		{"large number", `{"timestamp":1690000000000,"size":12345678901234567890}`, `[{"op":"add","path":"/a","value":1.5}]`, `{"a":1.5,"size":12345678901234567890,"timestamp":1690000000000}`, ""},
+		{"missing parent", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, "", "add /baz/bat: missing key: baz"},
+		{"remove missing", `{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, "", "remove /baz: missing key: baz"},
+		{"replace missing", `{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`, "", "replace /baz: missing key: baz"},
+		{"invalid index", `{"foo":[1]}`, `[{"op":"add","path":"/foo/2","value":1}]`, "", "add /foo/2: invalid array index: 2"},
+		{"leading zero index", `{"foo":[1,2]}`, `[{"op":"remove","path":"/foo/01"}]`, "", "remove /foo/01: invalid array index: 01"},
+		{"move into itself", `{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, "", "move /foo/bar/baz: can't move a value into itself"},
+		{"missing value", `{}`, `[{"op":"add","path":"/foo"}]`, "", "add /foo: missing value"},
+		{"invalid op", `{}`, `[{"op":"delete","path":"/foo"}]`, "", "delete /foo: invalid operation: delete"},
+		{"invalid pointer", `{}`, `[{"op":"remove","path":"foo"}]`, "", "remove foo: invalid JSON pointer: foo"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, err := decodeJSON([]byte(tc.doc))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			var patch []JSONPatchOperation
+			if err := json.Unmarshal([]byte(tc.patch), &patch); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			patched, err := ApplyJSONPatch(doc, patch)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			data, err := json.Marshal(patched)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, string(data))
+		})
+	}
+}
+
+func TestJSONPatchOperationMarshal(t *testing.T) {
+	patch := []JSONPatchOperation{
+		{Op: "add", Path: "/a", Value: json.RawMessage("null")},
+		{Op: "remove", Path: "/b"},
+		{Op: "move", From: "/c", Path: "/d"},
+	}
+	data, err := json.Marshal(patch)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"op":"add","path":"/a","value":null},{"op":"remove","path":"/b"},{"op":"move","path":"/d","from":"/c"}]`, string(data))
+}
+
+func TestDiffJSON(t *testing.T) {
+	testCases := []struct {
+		name     string
+		a        string
+		b        string
+		expected string
+	}{
+		{"equal", `{"foo":{"bar":[1,2]}}`, `{"foo": {"bar": [1, 2]}}`, `[]`},
+		{"add and remove", `{"a":1,"b":2}`, `{"b":2,"c":{"d":3}}`, `[{"op":"remove","path":"/a"},{"op":"add","path":"/c","value":{"d":3}}]`},
+		{"nested replace", `{"packages":{"a":{"depends":["x"],"size":1}}}`, `{"packages":{"a":{"depends":["x","y"],"size":1}}}`, `[{"op":"replace","path":"/packages/a/depends","value":["x","y"]}]`},
+		{"escaped keys", `{"a/b":1,"m~n":2}`, `{"a/b":3}`, `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`},
+		{"whole document", `{"a":1}`, `[1]`, `[{"op":"replace","path":"","value":[1]}]`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			patch, err := DiffJSON([]byte(tc.a), []byte(tc.b))
+			assert.NoError(t, err)
+			encoded, err := json.Marshal(patch)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(encoded))
+
+			// Applying the diff to a gives b
+			doc, _ := decodeJSON([]byte(tc.a))
+			patched, err := ApplyJSONPatch(doc, patch)
+			assert.NoError(t, err)
+			result, _ := json.Marshal(patched)
+			assert.JSONEq(t, tc.b, string(result))
+		})
+	}
+
+	_, err := DiffJSON([]byte(`{}`), []byte(`{`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,281 @@
+// SPDX license expressions
+// https://spdx.github.io/spdx-spec/v2.3/SPDX-license-expressions/
+package repodata
+
+import (
+	"errors"
+	"strings"
+)
+
+// licenseExpression is a parsed SPDX license expression
+type licenseExpression interface {
+	// evaluate returns true if the expression is acceptable given a function that
+	// tests individual licenses
+	evaluate(acceptable func(license string) bool) bool
+}
+
+type licenseID struct {
+	// License identifier, including a trailing '+' if present
+	id string
+	// Exception identifier if the license has a WITH clause
+	exception string
+}
+
+func (l licenseID) evaluate(acceptable func(license string) bool) bool {
+	return acceptable(l.id)
+}
+
+type licenseAnd []licenseExpression
+
+func (a licenseAnd) evaluate(acceptable func(license string) bool) bool {
+	for _, e := range a {
+		if !e.evaluate(acceptable) {
+			return false
+		}
+	}
+	return true
+}
+
+type licenseOr []licenseExpression
+
+func (o licenseOr) evaluate(acceptable func(license string) bool) bool {
+	for _, e := range o {
+		if e.evaluate(acceptable) {
+			return true
+		}
+	}
+	return false
+}
+
+func tokeniseLicense(expression string) []string {
+	tokens := []string{}
+	for _, field := range strings.Fields(expression) {
+		for field != "" {
+			i := strings.IndexAny(field, "()")
+			if i < 0 {
+				tokens = append(tokens, field)
+				break
+			}
+			if i > 0 {
+				tokens = append(tokens, field[:i])
+			}
+			tokens = append(tokens, field[i:i+1])
+			field = field[i+1:]
+		}
+	}
+	return tokens
+}
+
+type licenseParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *licenseParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// isLicenseOperator returns true if token is the operator op, operators must be all
+// uppercase or all lowercase
+func isLicenseOperator(token string, op string) bool {
+	return token == op || token == strings.ToLower(op)
+}
+
+func isLicenseID(token string) bool {
+	if token == "" {
+		return false
+	}
+	for i, c := range token {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == ':':
+		case c == '+' && i == len(token)-1:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (p *licenseParser) parseOr() (licenseExpression, error) {
+	terms := licenseOr{}
+	for {
+		term, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		if !isLicenseOperator(p.peek(), "OR") {
+			break
+		}
+		p.pos++
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *licenseParser) parseAnd() (licenseExpression, error) {
+	terms := licenseAnd{}
+	for {
+		term, err := p.parseSimple()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		if !isLicenseOperator(p.peek(), "AND") {
+			break
+		}
+		p.pos++
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *licenseParser) parseSimple() (licenseExpression, error) {
+	token := p.peek()
+	p.pos++
+	if token == "(" {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing ')'")
+		}
+		p.pos++
+		return e, nil
+	}
+	if !isLicenseID(token) || isLicenseOperator(token, "AND") || isLicenseOperator(token, "OR") || isLicenseOperator(token, "WITH") {
+		return nil, errors.New("expected license identifier, got '" + token + "'")
+	}
+
+	license := licenseID{id: token}
+	if isLicenseOperator(p.peek(), "WITH") {
+		p.pos++
+		exception := p.peek()
+		p.pos++
+		if !isLicenseID(exception) {
+			return nil, errors.New("expected license exception identifier, got '" + exception + "'")
+		}
+		license.exception = exception
+	}
+	return license, nil
+}
+
+// parseLicenseExpression parses an SPDX license expression such as "MIT OR Apache-2.0"
+func parseLicenseExpression(expression string) (licenseExpression, error) {
+	p := licenseParser{tokens: tokeniseLicense(expression)}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("empty license expression")
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, errors.New("invalid license expression " + expression + ": " + err.Error())
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("invalid license expression " + expression + ": unexpected '" + p.tokens[p.pos] + "'")
+	}
+	return e, nil
+}
+
+// LicensePolicy allows or denies records based on their SPDX license expression
+type LicensePolicy struct {
+	// Allowed license identifiers (lowercase), empty to allow all licenses that aren't denied
+	allow *Set
+	// Allow OSI approved licenses
+	allowOsiApproved bool
+	// Denied license identifiers (lowercase)
+	deny *Set
+	// Allow records with a missing or unparseable license
+	fallbackAllow bool
+}
+
+// NewLicensePolicy creates a license policy
+//
+// fallback is "allow" or "deny", and is used for missing or unparseable licenses.
+func NewLicensePolicy(allow []string, allowOsiApproved bool, deny []string, fallback string) (*LicensePolicy, error) {
+	p := &LicensePolicy{
+		allow:            NewSet(nil),
+		allowOsiApproved: allowOsiApproved,
+		deny:             NewSet(nil),
+	}
+	for _, id := range allow {
+		p.allow.Add(strings.ToLower(id))
+	}
+	for _, id := range deny {
+		p.deny.Add(strings.ToLower(id))
+	}
+	switch fallback {
+	case "allow":
+		p.fallbackAllow = true
+	case "deny", "":
+		p.fallbackAllow = false
+	default:
+		return nil, errors.New("invalid license fallback, must be allow or deny: " + fallback)
+	}
+	return p, nil
+}
+
+// licenseIsAcceptable checks a single license identifier
+func (p *LicensePolicy) licenseIsAcceptable(id string) bool {
+	lower := strings.ToLower(id)
+	if p.deny.Contains(lower) || p.deny.Contains(strings.TrimSuffix(lower, "+")) {
+		return false
+	}
+	if p.allow.Len() == 0 && !p.allowOsiApproved {
+		return true
+	}
+	return p.allow.Contains(lower) || (p.allowOsiApproved && osiApprovedLicenses.Contains(lower))
+}
+
+// Check returns true if the license expression is acceptable, and a reason if it isn't
+func (p *LicensePolicy) Check(license string) (bool, string) {
+	license = strings.TrimSpace(license)
+	if license == "" || license == "NOASSERTION" {
+		return p.fallbackAllow, "missing license"
+	}
+	expression, err := parseLicenseExpression(license)
+	if err != nil {
+		return p.fallbackAllow, "unparseable license: " + license
+	}
+	if expression.evaluate(p.licenseIsAcceptable) {
+		return true, ""
+	}
+	return false, "license not allowed: " + license
+}
+
+// osiApprovedLicenses are the lowercase SPDX identifiers of OSI approved licenses
+// https://spdx.org/licenses/
+var osiApprovedLicenses = NewSet(&[]string{
+	"0bsd", "aal", "afl-1.1", "afl-1.2", "afl-2.0", "afl-2.1", "afl-3.0",
+	"agpl-3.0", "agpl-3.0-only", "agpl-3.0-or-later", "apl-1.0",
+	"apsl-1.0", "apsl-1.1", "apsl-1.2", "apsl-2.0", "apache-1.1", "apache-2.0",
+	"artistic-1.0", "artistic-1.0-cl8", "artistic-1.0-perl", "artistic-2.0",
+	"bsd-1-clause", "bsd-2-clause", "bsd-2-clause-patent", "bsd-3-clause", "bsd-3-clause-lbnl",
+	"bsl-1.0", "blueoak-1.0.0", "cal-1.0", "cal-1.0-combined-work-exception", "catosl-1.1",
+	"cddl-1.0", "cecill-2.1", "cern-ohl-p-2.0", "cern-ohl-s-2.0", "cern-ohl-w-2.0",
+	"cnri-python", "cpal-1.0", "cpl-1.0", "cua-opl-1.0", "ecl-1.0", "ecl-2.0",
+	"efl-1.0", "efl-2.0", "epl-1.0", "epl-2.0", "eudatagrid", "eupl-1.1", "eupl-1.2",
+	"entessa", "fair", "frameworx-1.0",
+	"gpl-2.0", "gpl-2.0+", "gpl-2.0-only", "gpl-2.0-or-later",
+	"gpl-3.0", "gpl-3.0+", "gpl-3.0-only", "gpl-3.0-or-later",
+	"hpnd", "ipa", "ipl-1.0", "isc", "intel",
+	"lgpl-2.0", "lgpl-2.0+", "lgpl-2.0-only", "lgpl-2.0-or-later",
+	"lgpl-2.1", "lgpl-2.1+", "lgpl-2.1-only", "lgpl-2.1-or-later",
+	"lgpl-3.0", "lgpl-3.0+", "lgpl-3.0-only", "lgpl-3.0-or-later",
+	"lpl-1.0", "lpl-1.02", "lppl-1.3c", "liliq-p-1.1", "liliq-r-1.1", "liliq-rplus-1.1",
+	"mit", "mit-0", "mit-modern-variant", "mpl-1.0", "mpl-1.1", "mpl-2.0",
+	"mpl-2.0-no-copyleft-exception", "ms-pl", "ms-rl", "miros", "motosoto", "mulanpsl-2.0",
+	"multics", "nasa-1.3", "ncsa", "ngpl", "nposl-3.0", "ntp", "naumen", "nokia",
+	"oclc-2.0", "ofl-1.1", "ofl-1.1-rfn", "ofl-1.1-no-rfn", "ogtsl", "oldap-2.8", "oset-pl-2.1",
+	"osl-1.0", "osl-2.0", "osl-2.1", "osl-3.0", "php-3.0", "php-3.01", "postgresql",
+	"python-2.0", "qpl-1.0", "rpl-1.1", "rpl-1.5", "rpsl-1.0", "rscpl", "sissl", "spl-1.0",
+	"simpl-2.0", "sleepycat", "ucl-1.0", "upl-1.0", "unicode-dfs-2016", "unlicense",
+	"vsl-1.0", "w3c", "watcom-1.0", "xnet", "zpl-2.0", "zpl-2.1", "zlib",
+})
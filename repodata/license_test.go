@@ -0,0 +1,91 @@
+package repodata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLicenseExpression(t *testing.T) {
+	valid := []string{
+		"MIT",
+		"MIT OR Apache-2.0",
+		"MIT AND (Apache-2.0 OR BSD-3-Clause)",
+		"(MIT)",
+		"GPL-2.0-or-later WITH Classpath-exception-2.0",
+		"GPL-2.0+",
+		"LicenseRef-Proprietary",
+		"mit or apache-2.0",
+	}
+	for _, license := range valid {
+		t.Run(license, func(t *testing.T) {
+			_, err := parseLicenseExpression(license)
+			assert.NoError(t, err)
+		})
+	}
+
+	invalid := []string{
+		"",
+		"MIT License",
+		"MIT OR",
+		"(MIT",
+		"MIT)",
+		"AND MIT",
+		"MIT WITH",
+		"GPL+2",
+		"Public Domain",
+		"MIT Or Apache-2.0",
+	}
+	for _, license := range invalid {
+		t.Run(license, func(t *testing.T) {
+			_, err := parseLicenseExpression(license)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLicensePolicyCheck(t *testing.T) {
+	denyOnly, err := NewLicensePolicy(nil, false, []string{"AGPL-3.0-only", "GPL-3.0"}, "allow")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	osiOnly, err := NewLicensePolicy([]string{"LicenseRef-Public-Domain"}, true, []string{"AGPL-3.0-only"}, "deny")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		name     string
+		policy   *LicensePolicy
+		license  string
+		expected bool
+		reason   string
+	}{
+		{"deny-allowed", denyOnly, "MIT", true, ""},
+		{"deny-denied", denyOnly, "AGPL-3.0-only", false, "license not allowed: AGPL-3.0-only"},
+		{"deny-case", denyOnly, "agpl-3.0-ONLY", false, "license not allowed: agpl-3.0-ONLY"},
+		{"deny-plus", denyOnly, "GPL-3.0+", false, "license not allowed: GPL-3.0+"},
+		{"deny-or", denyOnly, "AGPL-3.0-only OR MIT", true, ""},
+		{"deny-and", denyOnly, "AGPL-3.0-only AND MIT", false, "license not allowed: AGPL-3.0-only AND MIT"},
+		{"deny-missing", denyOnly, "", true, "missing license"},
+		{"deny-unparseable", denyOnly, "BSD License", true, "unparseable license: BSD License"},
+
+		{"osi-allowed", osiOnly, "Apache-2.0", true, ""},
+		{"osi-explicit", osiOnly, "LicenseRef-Public-Domain", true, ""},
+		{"osi-not-approved", osiOnly, "LicenseRef-Proprietary", false, "license not allowed: LicenseRef-Proprietary"},
+		{"osi-denied", osiOnly, "AGPL-3.0-only", false, "license not allowed: AGPL-3.0-only"},
+		{"osi-with", osiOnly, "GPL-2.0-or-later WITH Classpath-exception-2.0", true, ""},
+		{"osi-missing", osiOnly, "", false, "missing license"},
+		{"osi-unparseable", osiOnly, "BSD License", false, "unparseable license: BSD License"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, reason := tc.policy.Check(tc.license)
+			assert.Equal(t, tc.expected, ok)
+			assert.Equal(t, tc.reason, reason)
+		})
+	}
+
+	_, err = NewLicensePolicy(nil, false, nil, "maybe")
+	assert.Error(t, err)
+}
@@ -0,0 +1,237 @@
+// Lockfiles: conda-lock.yml, pixi.lock and @EXPLICIT files
+// https://conda.github.io/conda-lock/output/
+// https://pixi.sh/latest/features/lockfile/
+// https://docs.conda.io/projects/conda/en/latest/user-guide/tasks/manage-environments.html#building-identical-conda-environments
+package repodata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LockedPackage is a conda package referenced by a lockfile
+type LockedPackage struct {
+	URL string
+	// Channel name, e.g. conda-forge or conda-forge/label/dev
+	Channel  string
+	Subdir   string
+	Filename string
+	// Expected hashes, empty if not known
+	Sha256 string
+	Md5    string
+}
+
+// Path returns the filename including the subdir
+func (p *LockedPackage) Path() string {
+	return p.Subdir + "/" + p.Filename
+}
+
+// InChannel returns true if the package is from channel on host,
+// <host>/<channel>/<subdir>/<filename>
+//
+// host may include a path, e.g. a mirror's https://example.org/conda. The scheme
+// isn't compared. Labels, <host>/<channel>/label/<label>/..., are separate
+// channels that aren't served.
+func (p *LockedPackage) InChannel(host string, channel string) bool {
+	h, err := url.Parse(host)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || !strings.EqualFold(u.Host, h.Host) {
+		return false
+	}
+	channelPath := strings.TrimSuffix(h.Path, "/") + "/" + channel + "/"
+	return u.Path == channelPath+p.Subdir+"/"+p.Filename
+}
+
+// newLockedPackage creates a LockedPackage from a package URL
+func newLockedPackage(packageURL string, sha256 string, md5 string) (LockedPackage, error) {
+	u, err := url.Parse(packageURL)
+	if err != nil {
+		return LockedPackage{}, err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 3 {
+		return LockedPackage{}, errors.New("invalid package URL, expected .../<channel>/<subdir>/<filename>: " + packageURL)
+	}
+	n := len(parts)
+	p := LockedPackage{
+		URL:      packageURL,
+		Channel:  strings.Join(parts[:n-2], "/"),
+		Subdir:   parts[n-2],
+		Filename: parts[n-1],
+		Sha256:   strings.ToLower(sha256),
+		Md5:      strings.ToLower(md5),
+	}
+	if _, _, _, ok := ParsePackageFilename(p.Filename); !ok {
+		return LockedPackage{}, errors.New("invalid package filename: " + packageURL)
+	}
+	return p, nil
+}
+
+// parseExplicitLockfile parses an @EXPLICIT file, URLs may be followed by
+// #<md5>, #<sha256> or #sha256:<sha256>
+func parseExplicitLockfile(data []byte) ([]LockedPackage, error) {
+	packages := []LockedPackage{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '@' {
+			continue
+		}
+		packageURL, hash, _ := strings.Cut(line, "#")
+		sha256, md5 := "", ""
+		switch {
+		case strings.HasPrefix(hash, "sha256:"):
+			sha256 = strings.TrimPrefix(hash, "sha256:")
+		case len(hash) == 64:
+			sha256 = hash
+		case len(hash) == 32:
+			md5 = hash
+		case hash != "":
+			return nil, errors.New("invalid hash: " + line)
+		}
+		p, err := newLockedPackage(packageURL, sha256, md5)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, p)
+	}
+	return packages, scanner.Err()
+}
+
+type condaLockfile struct {
+	Version int `yaml:"version"`
+	Package []struct {
+		Manager string `yaml:"manager"`
+		URL     string `yaml:"url"`
+		Hash    struct {
+			Md5    string `yaml:"md5"`
+			Sha256 string `yaml:"sha256"`
+		} `yaml:"hash"`
+	} `yaml:"package"`
+}
+
+type pixiLockfile struct {
+	Version  int `yaml:"version"`
+	Packages []struct {
+		// Version < 6
+		Kind string `yaml:"kind"`
+		URL  string `yaml:"url"`
+		// Version 6
+		Conda string `yaml:"conda"`
+
+		Md5    string `yaml:"md5"`
+		Sha256 string `yaml:"sha256"`
+	} `yaml:"packages"`
+}
+
+// LoadLockfile loads the conda packages from a conda-lock.yml, pixi.lock or
+// @EXPLICIT file, other package managers such as pip are ignored
+func LoadLockfile(filename string) ([]LockedPackage, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	packages, err := parseLockfile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return packages, nil
+}
+
+func parseLockfile(data []byte) ([]LockedPackage, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "@EXPLICIT" {
+			return parseExplicitLockfile(data)
+		}
+	}
+
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	packages := []LockedPackage{}
+
+	if _, ok := keys["package"]; ok {
+		var lock condaLockfile
+		if err := yaml.Unmarshal(data, &lock); err != nil {
+			return nil, err
+		}
+		for _, pkg := range lock.Package {
+			if pkg.Manager != "conda" {
+				continue
+			}
+			p, err := newLockedPackage(pkg.URL, pkg.Hash.Sha256, pkg.Hash.Md5)
+			if err != nil {
+				return nil, err
+			}
+			packages = append(packages, p)
+		}
+		return packages, nil
+	}
+
+	if _, ok := keys["packages"]; ok {
+		var lock pixiLockfile
+		if err := yaml.Unmarshal(data, &lock); err != nil {
+			return nil, err
+		}
+		for _, pkg := range lock.Packages {
+			packageURL := pkg.Conda
+			if packageURL == "" && pkg.Kind == "conda" {
+				packageURL = pkg.URL
+			}
+			if packageURL == "" {
+				continue
+			}
+			p, err := newLockedPackage(packageURL, pkg.Sha256, pkg.Md5)
+			if err != nil {
+				return nil, err
+			}
+			packages = append(packages, p)
+		}
+		return packages, nil
+	}
+
+	return nil, errors.New("unknown lockfile format")
+}
+
+// CheckLockedPackages checks the hashes of the locked packages in a subdir
+// against the repodata
+//
+// Returns the paths of the locked packages that aren't in the repodata, and an
+// error listing all packages with mismatched hashes.
+func CheckLockedPackages(repodata *Repodata, locked []LockedPackage) ([]string, error) {
+	missing := []string{}
+	mismatched := []string{}
+	for _, p := range locked {
+		if p.Subdir != repodata.Info.Subdir {
+			continue
+		}
+		record, ok := repodata.Packages[p.Filename]
+		if !ok {
+			record, ok = repodata.PackagesConda[p.Filename]
+		}
+		if !ok {
+			missing = append(missing, p.Path())
+			continue
+		}
+		if p.Sha256 != "" && p.Sha256 != record.Sha256 {
+			mismatched = append(mismatched, fmt.Sprintf("%s sha256 %s != %s", p.Path(), p.Sha256, record.Sha256))
+		} else if p.Sha256 == "" && p.Md5 != "" && p.Md5 != record.Md5 {
+			mismatched = append(mismatched, fmt.Sprintf("%s md5 %s != %s", p.Path(), p.Md5, record.Md5))
+		}
+	}
+	if len(mismatched) > 0 {
+		return missing, errors.New("locked packages don't match repodata: " + strings.Join(mismatched, ", "))
+	}
+	return missing, nil
+}
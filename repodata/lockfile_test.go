@@ -0,0 +1,145 @@
+package repodata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadLockfile(t *testing.T) {
+	testCases := []struct {
+		filename string
+		expected []LockedPackage
+	}{
+		{"conda-lock.yml", []LockedPackage{
+			{
+				URL:      "https://conda.anaconda.org/conda-forge/noarch/a-0.1.0-0.tar.bz2",
+				Channel:  "conda-forge",
+				Subdir:   "noarch",
+				Filename: "a-0.1.0-0.tar.bz2",
+				Sha256:   "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+				Md5:      "0123456789abcdef0123456789abcdef",
+			},
+		}},
+		{"pixi.lock", []LockedPackage{
+			{
+				URL:      "https://conda.anaconda.org/conda-forge/linux-64/d-2023.1.1-0.conda",
+				Channel:  "conda-forge",
+				Subdir:   "linux-64",
+				Filename: "d-2023.1.1-0.conda",
+				Sha256:   "abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+				Md5:      "abcdef0123456789abcdef0123456789",
+			},
+		}},
+		{"explicit.txt", []LockedPackage{
+			{
+				URL:      "https://conda.anaconda.org/conda-forge/noarch/b-1-10.tar.bz2",
+				Channel:  "conda-forge",
+				Subdir:   "noarch",
+				Filename: "b-1-10.tar.bz2",
+				Md5:      "0123456789abcdef0123456789abcdef",
+			},
+			{
+				URL:      "https://conda.anaconda.org/conda-forge/label/dev/noarch/c-1.2.3-aaa_0.conda",
+				Channel:  "conda-forge/label/dev",
+				Subdir:   "noarch",
+				Filename: "c-1.2.3-aaa_0.conda",
+				Sha256:   "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			},
+			{
+				URL:      "https://conda.anaconda.org/bioconda/linux-64/e-12.34.56-78.conda",
+				Channel:  "bioconda",
+				Subdir:   "linux-64",
+				Filename: "e-12.34.56-78.conda",
+			},
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.filename, func(t *testing.T) {
+			packages, err := LoadLockfile("testdata/lockfiles/" + tc.filename)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			assert.Equal(t, tc.expected, packages)
+		})
+	}
+}
+
+func TestParseLockfileInvalid(t *testing.T) {
+	_, err := parseLockfile([]byte("name: not-a-lockfile\n"))
+	assert.EqualError(t, err, "unknown lockfile format")
+
+	_, err = parseLockfile([]byte("@EXPLICIT\nhttps://conda.anaconda.org/numpy.conda\n"))
+	assert.ErrorContains(t, err, "invalid package URL")
+
+	_, err = parseLockfile([]byte("@EXPLICIT\nhttps://conda.anaconda.org/conda-forge/noarch/a-1-0.conda#1234\n"))
+	assert.ErrorContains(t, err, "invalid hash")
+}
+
+func TestLockedPackageInChannel(t *testing.T) {
+	testCases := []struct {
+		url     string
+		host    string
+		channel string
+		in      bool
+	}{
+		{"https://conda.anaconda.org/conda-forge/noarch/a-1-0.conda", "https://conda.anaconda.org", "conda-forge", true},
+		{"https://conda.anaconda.org/conda-forge/noarch/a-1-0.conda", "https://conda.anaconda.org/", "conda-forge", true},
+		{"http://Conda.Anaconda.org/conda-forge/noarch/a-1-0.conda", "https://conda.anaconda.org", "conda-forge", true},
+		{"https://conda.anaconda.org/conda-forge/label/dev/noarch/a-1-0.conda", "https://conda.anaconda.org", "conda-forge", false},
+		{"https://example.org/conda/conda-forge/noarch/a-1-0.conda", "https://example.org/conda", "conda-forge", true},
+		{"https://conda.anaconda.org/conda-forge/noarch/a-1-0.conda", "https://example.org", "conda-forge", false},
+		{"https://example.org/conda/conda-forge/noarch/a-1-0.conda", "https://example.org", "conda-forge", false},
+		{"https://conda.anaconda.org/bioconda/noarch/a-1-0.conda", "https://conda.anaconda.org", "conda-forge", false},
+		{"https://conda.anaconda.org/conda-forge-x/noarch/a-1-0.conda", "https://conda.anaconda.org", "conda-forge", false},
+		{"https://conda.anaconda.org/x/conda-forge/noarch/a-1-0.conda", "https://conda.anaconda.org", "conda-forge", false},
+		{"https://conda.anaconda.org/conda-forge/x/noarch/a-1-0.conda", "https://conda.anaconda.org", "conda-forge", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			p, err := newLockedPackage(tc.url, "", "")
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			assert.Equal(t, tc.in, p.InChannel(tc.host, tc.channel), tc.host+" "+tc.channel)
+		})
+	}
+}
+
+func TestCheckLockedPackages(t *testing.T) {
+	repodata := &Repodata{
+		Info: RepodataInfo{Subdir: "noarch"},
+		Packages: map[string]RepodataRecord{
+			"a-1-0.tar.bz2": {Subdir: "noarch", Name: "a", Version: "1", Build: "0", Sha256: "aaaa", Md5: "1111"},
+		},
+		PackagesConda: map[string]RepodataRecord{
+			"b-1-0.conda": {Subdir: "noarch", Name: "b", Version: "1", Build: "0", Sha256: "bbbb", Md5: "2222"},
+		},
+	}
+
+	locked := []LockedPackage{
+		{Subdir: "noarch", Filename: "a-1-0.tar.bz2", Sha256: "aaaa"},
+		{Subdir: "noarch", Filename: "b-1-0.conda", Md5: "2222"},
+		{Subdir: "noarch", Filename: "c-1-0.conda", Sha256: "cccc"},
+		{Subdir: "linux-64", Filename: "d-1-0.conda", Sha256: "dddd"},
+	}
+	missing, err := CheckLockedPackages(repodata, locked)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"noarch/c-1-0.conda"}, missing)
+
+	locked = []LockedPackage{
+		{Subdir: "noarch", Filename: "a-1-0.tar.bz2", Sha256: "ffff", Md5: "1111"},
+		{Subdir: "noarch", Filename: "b-1-0.conda", Md5: "ffff"},
+	}
+	_, err = CheckLockedPackages(repodata, locked)
+	assert.EqualError(t, err, "locked packages don't match repodata: noarch/a-1-0.tar.bz2 sha256 ffff != aaaa, noarch/b-1-0.conda md5 ffff != 2222")
+}
+
+func TestCheckRecordLocked(t *testing.T) {
+	policy := &FilterPolicy{Allowed: newTestPackageList(t, "a 2"), LockedFiles: NewSet(&[]string{"noarch/a-1-0.conda"})}
+
+	rule, _ := checkRecord("noarch/a-1-0.conda", &RepodataRecord{Name: "a", Version: "1"}, policy)
+	assert.Equal(t, "", rule)
+	rule, _ = checkRecord("noarch/a-1-1.conda", &RepodataRecord{Name: "a", Version: "1"}, policy)
+	assert.Equal(t, RuleNotAllowed, rule)
+}
@@ -0,0 +1,459 @@
+// Conda MatchSpec parsing
+// https://docs.conda.io/projects/conda-build/en/stable/resources/package-spec.html#package-match-specifications
+package repodata
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// versionMatcher tests whether a version matches a version specification
+type versionMatcher interface {
+	matches(v *Version) bool
+}
+
+type anyVersion struct{}
+
+func (anyVersion) matches(v *Version) bool {
+	return true
+}
+
+type versionOperator struct {
+	op      string
+	version *Version
+}
+
+func (o versionOperator) matches(v *Version) bool {
+	switch o.op {
+	case "==":
+		return v.Compare(o.version) == 0
+	case "!=":
+		return v.Compare(o.version) != 0
+	case "<":
+		return v.Compare(o.version) < 0
+	case "<=":
+		return v.Compare(o.version) <= 0
+	case ">":
+		return v.Compare(o.version) > 0
+	case ">=":
+		return v.Compare(o.version) >= 0
+	case "=":
+		return v.StartsWith(o.version)
+	case "!=startswith":
+		return !v.StartsWith(o.version)
+	case "~=":
+		// Compatible release, e.g. ~=1.2.3 is >=1.2.3,1.2.*
+		if v.Compare(o.version) < 0 {
+			return false
+		}
+		prefix := &Version{version: o.version.version[:len(o.version.version)-1]}
+		return len(prefix.version) == 0 || v.StartsWith(prefix)
+	}
+	return false
+}
+
+type versionRegex struct {
+	re *regexp.Regexp
+}
+
+func (r versionRegex) matches(v *Version) bool {
+	return r.re.MatchString(v.raw)
+}
+
+type versionAnd []versionMatcher
+
+func (a versionAnd) matches(v *Version) bool {
+	for _, m := range a {
+		if !m.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+type versionOr []versionMatcher
+
+func (o versionOr) matches(v *Version) bool {
+	for _, m := range o {
+		if m.matches(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// VersionSpec is a parsed conda version specification such as ">=1.24,<2" or "2.1.*"
+type VersionSpec struct {
+	raw     string
+	matcher versionMatcher
+}
+
+var versionOperatorRe = regexp.MustCompile(`^(==|!=|<=|>=|~=|<|>|=)?\s*(\S+)$`)
+
+// ParseVersionSpec parses a conda version specification
+//
+// Supports the operators ==, !=, <, <=, >, >=, ~= and =, trailing .* wildcards,
+// regular expressions (^...$), ',' (and), '|' (or) and parentheses.
+func ParseVersionSpec(spec string) (*VersionSpec, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, errors.New("empty version spec")
+	}
+	p := versionSpecParser{input: spec}
+	matcher, err := p.parseOr()
+	if err != nil {
+		return nil, errors.New("invalid version spec " + spec + ": " + err.Error())
+	}
+	if p.pos < len(p.input) {
+		return nil, errors.New("invalid version spec " + spec + ": unexpected '" + p.input[p.pos:] + "'")
+	}
+	return &VersionSpec{raw: spec, matcher: matcher}, nil
+}
+
+// Matches returns true if version matches the spec
+func (s *VersionSpec) Matches(version *Version) bool {
+	return s.matcher.matches(version)
+}
+
+func (s *VersionSpec) String() string {
+	return s.raw
+}
+
+type versionSpecParser struct {
+	input string
+	pos   int
+}
+
+func (p *versionSpecParser) skipSpace() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *versionSpecParser) parseOr() (versionMatcher, error) {
+	terms := versionOr{}
+	for {
+		term, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		p.skipSpace()
+		if p.pos >= len(p.input) || p.input[p.pos] != '|' {
+			break
+		}
+		p.pos++
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *versionSpecParser) parseAnd() (versionMatcher, error) {
+	terms := versionAnd{}
+	for {
+		term, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		p.skipSpace()
+		if p.pos >= len(p.input) || p.input[p.pos] != ',' {
+			break
+		}
+		p.pos++
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *versionSpecParser) parseTerm() (versionMatcher, error) {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == '(' {
+		p.pos++
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.input) || p.input[p.pos] != ')' {
+			return nil, errors.New("missing ')'")
+		}
+		p.pos++
+		return m, nil
+	}
+
+	end := p.pos
+	for end < len(p.input) && !strings.ContainsRune(",|()", rune(p.input[end])) {
+		end++
+	}
+	term := strings.TrimSpace(p.input[p.pos:end])
+	p.pos = end
+	if term == "" {
+		return nil, errors.New("empty version constraint")
+	}
+	return parseVersionConstraint(term)
+}
+
+// parseVersionConstraint parses a single constraint such as ">=1.2" or "1.2.*"
+func parseVersionConstraint(term string) (versionMatcher, error) {
+	if term == "*" {
+		return anyVersion{}, nil
+	}
+	if strings.HasPrefix(term, "^") || strings.HasSuffix(term, "$") {
+		if !strings.HasPrefix(term, "^") || !strings.HasSuffix(term, "$") {
+			return nil, errors.New("regex version must start with '^' and end with '$': " + term)
+		}
+		re, err := regexp.Compile(term)
+		if err != nil {
+			return nil, err
+		}
+		return versionRegex{re}, nil
+	}
+
+	m := versionOperatorRe.FindStringSubmatch(term)
+	if m == nil {
+		return nil, errors.New("invalid version constraint: " + term)
+	}
+	op, value := m[1], m[2]
+
+	wildcard := false
+	if strings.HasSuffix(value, "*") {
+		wildcard = true
+		value = strings.TrimSuffix(strings.TrimSuffix(value, "*"), ".")
+	}
+
+	switch {
+	case op == "" && wildcard, op == "==" && wildcard:
+		op = "="
+	case op == "":
+		op = "=="
+	case op == "!=" && wildcard:
+		op = "!=startswith"
+	case op == "~=" && wildcard:
+		return nil, errors.New("invalid version constraint, ~= cannot be used with *: " + term)
+	}
+	// Other operators ignore trailing wildcards, e.g. >=1.2.* is >=1.2
+
+	version, err := ParseVersion(value)
+	if err != nil {
+		return nil, err
+	}
+	return versionOperator{op, version}, nil
+}
+
+// MatchSpec is a parsed conda match specification such as "numpy >=1.24,<2" or "pytorch 2.1.* *cuda*"
+type MatchSpec struct {
+	raw string
+	// Channel, if the spec was prefixed with "channel::"
+	Channel string
+	// Package name, or a name pattern such as "r-*" or "re:^jupyterlab-.*$"
+	Name string
+	// Compiled name pattern, nil if Name is an exact name
+	namePattern *regexp.Regexp
+	// Literal prefix of namePattern, used to quickly reject names
+	namePrefix string
+	// Version constraint, nil if any version is allowed
+	Version *VersionSpec
+	// Build string glob, empty if any build is allowed
+	Build string
+}
+
+var matchSpecBracketRe = regexp.MustCompile(`^([^\[]*)\[(.*=.*)\]$`)
+var matchSpecBracketPairRe = regexp.MustCompile(`\s*([a-z_]+)\s*=\s*(?:'([^']*)'|"([^"]*)"|([^,\s]*))\s*,?`)
+var matchSpecNameRe = regexp.MustCompile(`^([^ =<>!~]+)\s*(.*)$`)
+
+// ParseMatchSpec parses a conda MatchSpec string
+//
+// Supports "name", "name version", "name version build", "name=version=build",
+// "name>=1,<2", "channel::name" and "name[version='>=1',build='*cuda*']" forms.
+func ParseMatchSpec(spec string) (*MatchSpec, error) {
+	s := strings.TrimSpace(spec)
+	// Strip trailing comments
+	if i := strings.Index(s, "#"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if s == "" {
+		return nil, errors.New("empty match spec")
+	}
+
+	ms := &MatchSpec{raw: s}
+
+	brackets := map[string]string{}
+	if m := matchSpecBracketRe.FindStringSubmatch(s); m != nil {
+		s = strings.TrimSpace(m[1])
+		for _, pair := range matchSpecBracketPairRe.FindAllStringSubmatch(m[2], -1) {
+			brackets[pair[1]] = pair[2] + pair[3] + pair[4]
+		}
+	}
+
+	if i := strings.LastIndex(s, "::"); i >= 0 {
+		ms.Channel = s[:i]
+		s = s[i+2:]
+	}
+
+	m := matchSpecNameRe.FindStringSubmatch(s)
+	if m == nil {
+		return nil, errors.New("invalid match spec, missing name: " + spec)
+	}
+	ms.Name = m[1]
+	if err := ms.compileNamePattern(); err != nil {
+		return nil, errors.New("invalid match spec " + spec + ": " + err.Error())
+	}
+	version, build, err := parseVersionAndBuild(m[2])
+	if err != nil {
+		return nil, errors.New("invalid match spec " + spec + ": " + err.Error())
+	}
+
+	if v, ok := brackets["version"]; ok {
+		version = v
+	}
+	if b, ok := brackets["build"]; ok {
+		build = b
+	}
+
+	if version != "" && version != "*" {
+		ms.Version, err = ParseVersionSpec(version)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if build != "*" {
+		ms.Build = build
+	}
+	return ms, nil
+}
+
+// parseVersionAndBuild splits the part of a MatchSpec after the name into a version and build
+func parseVersionAndBuild(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", "", nil
+	}
+
+	// "version build", the version may contain spaces after operators, e.g. ">= 1.2"
+	version, build := s, ""
+	if i := strings.LastIndex(s, " "); i >= 0 && !strings.ContainsAny(s[i+1:], "=<>!~|,") &&
+		!strings.ContainsAny(s[i-1:i], "=<>!~|,") {
+		version, build = strings.TrimSpace(s[:i]), s[i+1:]
+	}
+
+	if build == "" && strings.HasPrefix(version, "=") && !strings.HasPrefix(version, "==") {
+		// "=version=build" or "=version"
+		parts := strings.Split(version[1:], "=")
+		switch len(parts) {
+		case 1:
+			version = parts[0]
+			if !strings.HasSuffix(version, "*") && !strings.ContainsAny(version, ",|") {
+				version += "*"
+			}
+		case 2:
+			version, build = parts[0], parts[1]
+		default:
+			return "", "", errors.New("too many '=' in " + s)
+		}
+	} else if strings.HasPrefix(version, "==") && !strings.ContainsAny(version[2:], "=,|<>!~") && build == "" {
+		// "==version=build"
+		if parts := strings.SplitN(version[2:], "=", 2); len(parts) == 2 {
+			version, build = "=="+parts[0], parts[1]
+		}
+	}
+	if strings.Contains(build, " ") {
+		return "", "", errors.New("unexpected whitespace in build " + build)
+	}
+	return version, build, nil
+}
+
+// compileNamePattern compiles the name if it's a pattern
+//
+// Names can be globs using '*' and '?' (e.g. "ros-humble-*"), regular expressions
+// prefixed with "re:" (e.g. "re:jupyterlab-.*"), or conda style regular expressions
+// (e.g. "^jupyterlab-.*$"). Patterns must match the whole name.
+func (m *MatchSpec) compileNamePattern() error {
+	var expr string
+	switch {
+	case strings.HasPrefix(m.Name, "re:"):
+		expr = m.Name[3:]
+	case strings.HasPrefix(m.Name, "^") && strings.HasSuffix(m.Name, "$"):
+		expr = m.Name
+	case strings.ContainsAny(m.Name, "*?"):
+		var b strings.Builder
+		for _, c := range m.Name {
+			switch c {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		expr = b.String()
+	default:
+		return nil
+	}
+
+	// Remove existing anchors so the literal prefix can be found
+	expr = strings.TrimPrefix(expr, "^")
+	if strings.HasSuffix(expr, "$") && !strings.HasSuffix(expr, `\$`) {
+		expr = expr[:len(expr)-1]
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return err
+	}
+	m.namePattern = re
+	m.namePrefix, _ = re.LiteralPrefix()
+	return nil
+}
+
+// IsNamePattern returns true if the name is a glob or regular expression
+func (m *MatchSpec) IsNamePattern() bool {
+	return m.namePattern != nil
+}
+
+// MatchesName returns true if a package name matches the spec's name or name pattern
+func (m *MatchSpec) MatchesName(name string) bool {
+	if m.namePattern == nil {
+		return name == m.Name
+	}
+	return strings.HasPrefix(name, m.namePrefix) && m.namePattern.MatchString(name)
+}
+
+func (m *MatchSpec) String() string {
+	return m.raw
+}
+
+// MatchesVersionBuild returns true if a version and build string match the spec
+func (m *MatchSpec) MatchesVersionBuild(version *Version, build string) bool {
+	if m.Version != nil && (version == nil || !m.Version.Matches(version)) {
+		return false
+	}
+	if m.Build != "" {
+		matched, err := path.Match(m.Build, build)
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches returns true if a record matches the spec
+func (m *MatchSpec) Matches(record *RepodataRecord) bool {
+	if !m.MatchesName(record.Name) {
+		return false
+	}
+	if m.Version == nil {
+		return m.MatchesVersionBuild(nil, record.Build)
+	}
+	version, err := ParseVersion(record.Version)
+	if err != nil {
+		return false
+	}
+	return m.MatchesVersionBuild(version, record.Build)
+}
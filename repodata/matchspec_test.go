@@ -0,0 +1,198 @@
+package repodata
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionSpecMatches(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		version  string
+		expected bool
+	}{
+		{"1.2", "1.2", true},
+		{"1.2", "1.2.0", true},
+		{"1.2", "1.2.1", false},
+		{"1.2.*", "1.2.1", true},
+		{"1.2*", "1.2.1", true},
+		{"1.2.*", "1.20", false},
+		{"=1.2", "1.2.1", true},
+		{"==1.2", "1.2.1", false},
+		{"!=1.2", "1.2.1", true},
+		{"!=1.2.*", "1.2.1", false},
+		{">=1.24,<2", "1.26.0", true},
+		{">=1.24,<2", "1.23.5", false},
+		{">=1.24,<2", "2.0.0", false},
+		// Pre-releases sort before the release
+		{">=1.24,<2", "2.0.0rc1", true},
+		{"<2.0.0a0", "2.0.0rc1", false},
+		{"<1.0|>2", "0.5", true},
+		{"<1.0|>2", "1.5", false},
+		{"<1.0|>2", "3", true},
+		{"(>=1,<2)|(>=3,<4)", "3.5", true},
+		{"(>=1,<2)|(>=3,<4)", "2.5", false},
+		{">=1.2,<2|3.*", "3.1", true},
+		{"~=1.2.3", "1.2.5", true},
+		{"~=1.2.3", "1.3.0", false},
+		{"~=1.2.3", "1.2.2", false},
+		{">= 1.2", "1.3", true},
+		{">1.2.*", "1.3", true},
+		{"^1\\.2\\.[0-9]+$", "1.2.33", true},
+		{"^1\\.2\\.[0-9]+$", "1.3.0", false},
+		{"*", "9.9", true},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s,%s", tc.spec, tc.version), func(t *testing.T) {
+			s, err := ParseVersionSpec(tc.spec)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			assert.Equal(t, tc.expected, s.Matches(mustParseVersion(t, tc.version)))
+		})
+	}
+}
+
+func TestParseVersionSpecInvalid(t *testing.T) {
+	for _, spec := range []string{"", ">=", "(1.2", "1.2)", ">=1,", "~=1.*", "^1.2"} {
+		t.Run(spec, func(t *testing.T) {
+			_, err := ParseVersionSpec(spec)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseMatchSpec(t *testing.T) {
+	testCases := []struct {
+		spec    string
+		channel string
+		name    string
+		version string
+		build   string
+	}{
+		{"numpy", "", "numpy", "", ""},
+		{"numpy >=1.24,<2", "", "numpy", ">=1.24,<2", ""},
+		{"numpy>=1.24,<2", "", "numpy", ">=1.24,<2", ""},
+		{"numpy >=1.24, <2", "", "numpy", ">=1.24, <2", ""},
+		{"pytorch 2.1.* *cuda*", "", "pytorch", "2.1.*", "*cuda*"},
+		{"openssl 3.*", "", "openssl", "3.*", ""},
+		{"python 3.10", "", "python", "3.10", ""},
+		{"python=3.10", "", "python", "3.10*", ""},
+		{"python==3.10", "", "python", "==3.10", ""},
+		{"python=3.10=h_0", "", "python", "3.10", "h_0"},
+		{"python 3.10 h_0", "", "python", "3.10", "h_0"},
+		{"python * h_0", "", "python", "", "h_0"},
+		{"conda-forge::python >=3.10", "conda-forge", "python", ">=3.10", ""},
+		{"python[version='>=3.10',build=h_*]", "", "python", ">=3.10", "h_*"},
+		{"python >= 3.10  # comment", "", "python", ">= 3.10", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			ms, err := ParseMatchSpec(tc.spec)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			assert.Equal(t, tc.channel, ms.Channel)
+			assert.Equal(t, tc.name, ms.Name)
+			if tc.version == "" {
+				assert.Nil(t, ms.Version)
+			} else {
+				assert.Equal(t, tc.version, ms.Version.String())
+			}
+			assert.Equal(t, tc.build, ms.Build)
+		})
+	}
+}
+
+func TestMatchSpecMatches(t *testing.T) {
+	record := RepodataRecord{Name: "pytorch", Version: "2.1.0", Build: "cuda120_py311h_300"}
+
+	testCases := []struct {
+		spec     string
+		expected bool
+	}{
+		{"pytorch", true},
+		{"torch", false},
+		{"pytorch 2.1.*", true},
+		{"pytorch 2.1.* *cuda*", true},
+		{"pytorch 2.1.* *cpu*", false},
+		{"pytorch >=2.1,<2.2", true},
+		{"pytorch <2", false},
+		{"pytorch=2.1", true},
+		{"pytorch=2.1=cuda120_py311h_300", true},
+		{"pytorch=2.1=cuda120_py311h_301", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			ms, err := ParseMatchSpec(tc.spec)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			assert.Equal(t, tc.expected, ms.Matches(&record))
+		})
+	}
+}
+
+func TestMatchSpecNamePattern(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		name     string
+		expected bool
+	}{
+		{"r-*", "r-base", true},
+		{"r-*", "r", false},
+		{"r-*", "jupyter-r-kernel", false},
+		{"ros-humble-*", "ros-humble-rclpy", true},
+		{"ros-humble-*", "ros-iron-rclpy", false},
+		{"py?", "py3", true},
+		{"py?", "py", false},
+		{"lib.so*", "lib.so.1", true},
+		{"lib.so*", "libxso1", false},
+		{"re:^jupyterlab-.*$", "jupyterlab-git", true},
+		{"re:^jupyterlab-.*$", "jupyterlab", false},
+		{"re:jupyterlab-.*", "jupyterlab-git", true},
+		{"re:jupyterlab-.*", "my-jupyterlab-git", false},
+		{"^jupyterlab-.*$", "jupyterlab-git", true},
+		{"re:(numpy|scipy)", "scipy", true},
+		{"re:(numpy|scipy)", "numpy-base", false},
+		{"numpy", "numpy", true},
+		{"numpy", "numpy-base", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.spec+","+tc.name, func(t *testing.T) {
+			ms, err := ParseMatchSpec(tc.spec)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			assert.Equal(t, tc.spec != "numpy", ms.IsNamePattern())
+			assert.Equal(t, tc.expected, ms.MatchesName(tc.name))
+		})
+	}
+}
+
+func TestMatchSpecNamePatternPrefix(t *testing.T) {
+	for _, spec := range []string{"ros-humble-*", "re:^ros-humble-.*$", "re:ros-humble-.*"} {
+		t.Run(spec, func(t *testing.T) {
+			ms, err := ParseMatchSpec(spec)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			assert.Equal(t, "ros-humble-", ms.namePrefix)
+		})
+	}
+}
+
+func TestMatchSpecNamePatternVersion(t *testing.T) {
+	ms, err := ParseMatchSpec("r-* >=4.3")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.True(t, ms.Matches(&RepodataRecord{Name: "r-base", Version: "4.3.1"}))
+	assert.False(t, ms.Matches(&RepodataRecord{Name: "r-base", Version: "4.2.3"}))
+	assert.False(t, ms.Matches(&RepodataRecord{Name: "python", Version: "4.3.1"}))
+
+	_, err = ParseMatchSpec("re:(unclosed")
+	assert.Error(t, err)
+}
@@ -0,0 +1,204 @@
+// Lists of package names and MatchSpecs
+package repodata
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PackageList is a list of package MatchSpecs, indexed by package name
+//
+// A package name listed without any version or build constraint matches all
+// records with that name. Names may also be patterns such as "r-*" or
+// "re:^jupyterlab-.*$".
+//
+// Lookups are safe for concurrent use, e.g. by the proxy or when subdirs are
+// filtered in parallel. The list must not be modified concurrently with lookups.
+type PackageList struct {
+	specs map[string][]*MatchSpec
+	// MatchSpecs with a name pattern
+	patterns []*MatchSpec
+	// Pattern MatchSpecs that match a name, cached since repodata has many
+	// records for each name. Names aren't known until they're looked up so the
+	// cache is filled lazily, guarded by patternCacheLock.
+	patternCache     map[string][]*MatchSpec
+	patternCacheLock sync.RWMutex
+}
+
+func NewPackageList() *PackageList {
+	return &PackageList{
+		specs:        make(map[string][]*MatchSpec),
+		patternCache: make(map[string][]*MatchSpec),
+	}
+}
+
+// ParsePackageList parses a list of package names or MatchSpecs
+func ParsePackageList(specs []string) (*PackageList, error) {
+	l := NewPackageList()
+	for _, s := range specs {
+		if err := l.AddSpec(s); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// ParsePackageListFromFile parses a plain text file with a list of package names or MatchSpecs
+//
+// File should contain one name or MatchSpec per line, e.g. `numpy >=1.24,<2`,
+// without a channel prefix.
+// Leading/trailing whitespace is stripped.
+// Lines starting with '#' are ignored.
+func ParsePackageListFromFile(filename string) (*PackageList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := NewPackageList()
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && line[0] != '#' {
+			if err := l.AddSpec(line); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", filename, lineNumber, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Add adds a MatchSpec to the list
+func (l *PackageList) Add(spec *MatchSpec) {
+	if spec.IsNamePattern() {
+		l.patterns = append(l.patterns, spec)
+		l.patternCacheLock.Lock()
+		l.patternCache = make(map[string][]*MatchSpec)
+		l.patternCacheLock.Unlock()
+	} else {
+		l.specs[spec.Name] = append(l.specs[spec.Name], spec)
+	}
+}
+
+// AddSpec parses and adds a MatchSpec to the list
+//
+// A "channel::" prefix is an error, lists apply to every record they're checked
+// against so the prefix would be ignored. Use the channel's own list instead.
+func (l *PackageList) AddSpec(spec string) error {
+	ms, err := ParseMatchSpec(spec)
+	if err != nil {
+		return err
+	}
+	if ms.Channel != "" {
+		return fmt.Errorf("channel prefix %s:: isn't supported, use the channel's own list: %s", ms.Channel, spec)
+	}
+	l.Add(ms)
+	return nil
+}
+
+// Len returns the number of package names and name patterns in the list
+func (l *PackageList) Len() int {
+	return len(l.specs) + len(l.patterns)
+}
+
+// ContainsName returns true if any version of the package is in the list
+func (l *PackageList) ContainsName(name string) bool {
+	return len(l.Specs(name)) > 0
+}
+
+// Names returns the set of exact package names in the list, excluding patterns
+func (l *PackageList) Names() *Set {
+	names := NewSet(nil)
+	for name := range l.specs {
+		names.Add(name)
+	}
+	return names
+}
+
+// MatchingNames returns the names in candidates that match a name or pattern in the list
+func (l *PackageList) MatchingNames(candidates *Set) *Set {
+	names := NewSet(nil)
+	for _, name := range *candidates.Items() {
+		if l.ContainsName(name) {
+			names.Add(name)
+		}
+	}
+	return names
+}
+
+// Specs returns the MatchSpecs for a package name, including matching patterns
+func (l *PackageList) Specs(name string) []*MatchSpec {
+	if len(l.patterns) == 0 {
+		return l.specs[name]
+	}
+
+	l.patternCacheLock.RLock()
+	patternSpecs, ok := l.patternCache[name]
+	l.patternCacheLock.RUnlock()
+	if !ok {
+		patternSpecs = []*MatchSpec{}
+		for _, spec := range l.patterns {
+			if spec.MatchesName(name) {
+				patternSpecs = append(patternSpecs, spec)
+			}
+		}
+		l.patternCacheLock.Lock()
+		l.patternCache[name] = patternSpecs
+		l.patternCacheLock.Unlock()
+	}
+	if len(patternSpecs) == 0 {
+		return l.specs[name]
+	}
+	return append(append([]*MatchSpec{}, l.specs[name]...), patternSpecs...)
+}
+
+// Matches returns true if the record matches any MatchSpec in the list
+func (l *PackageList) Matches(record *RepodataRecord) bool {
+	return l.MatchingSpec(record) != nil
+}
+
+// MatchesPinned returns true if the record matches a MatchSpec in the list that
+// has a version or build constraint
+func (l *PackageList) MatchesPinned(record *RepodataRecord) bool {
+	return l.matchingSpec(record, func(spec *MatchSpec) bool {
+		return spec.Version != nil || spec.Build != ""
+	}) != nil
+}
+
+// MatchingSpec returns the first MatchSpec in the list that matches the record, or nil
+func (l *PackageList) MatchingSpec(record *RepodataRecord) *MatchSpec {
+	return l.matchingSpec(record, nil)
+}
+
+// matchingSpec returns the first MatchSpec accepted by include (nil to include all)
+// that matches the record, or nil
+func (l *PackageList) matchingSpec(record *RepodataRecord, include func(*MatchSpec) bool) *MatchSpec {
+	specs := l.Specs(record.Name)
+
+	// Only parse the version if it's needed, and only once
+	var version *Version
+	parsed := false
+	for _, spec := range specs {
+		if include != nil && !include(spec) {
+			continue
+		}
+		if spec.Version != nil && !parsed {
+			// An invalid version never matches a version constraint
+			version, _ = ParseVersion(record.Version)
+			parsed = true
+		}
+		if spec.MatchesVersionBuild(version, record.Build) {
+			return spec
+		}
+	}
+	return nil
+}
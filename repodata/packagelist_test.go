@@ -0,0 +1,114 @@
+package repodata
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePackageListFromFile(t *testing.T) {
+	allowedFile := writeTestdataToTmpfile(t, "allowed_matchspecs.txt")
+	allowed, err := ParsePackageListFromFile(allowedFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.ElementsMatch(t, []string{"bar", "baz", "foo", "numpy", "openssl"}, *allowed.Names().Items())
+	assert.Equal(t, 5, allowed.Len())
+	assert.Equal(t, 2, len(allowed.Specs("numpy")))
+}
+
+func TestParsePackageListFromFileInvalid(t *testing.T) {
+	tmpfile := filepath.Join(t.TempDir(), "invalid.txt")
+	if err := os.WriteFile(tmpfile, []byte("foo\nbar >=\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err := ParsePackageListFromFile(tmpfile)
+	assert.ErrorContains(t, err, "invalid.txt:2:")
+
+	// Channel prefixes would apply to every channel
+	if err := os.WriteFile(tmpfile, []byte("foo\ndefaults::openssl\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = ParsePackageListFromFile(tmpfile)
+	assert.EqualError(t, err, tmpfile+":2: channel prefix defaults:: isn't supported, use the channel's own list: defaults::openssl")
+
+	_, err = ParsePackageList([]string{"bioconda::foo >=1"})
+	assert.EqualError(t, err, "channel prefix bioconda:: isn't supported, use the channel's own list: bioconda::foo >=1")
+}
+
+func TestPackageListMatches(t *testing.T) {
+	l := newTestPackageList(t, "foo", "numpy >=1.24,<2", "numpy 1.21.*", "openssl 3.*")
+
+	testCases := []struct {
+		record   RepodataRecord
+		expected bool
+	}{
+		{RepodataRecord{Name: "foo", Version: "0.0.1"}, true},
+		{RepodataRecord{Name: "foo", Version: "not a version!"}, true},
+		{RepodataRecord{Name: "bar", Version: "1"}, false},
+		{RepodataRecord{Name: "numpy", Version: "1.21.6"}, true},
+		{RepodataRecord{Name: "numpy", Version: "1.22.0"}, false},
+		{RepodataRecord{Name: "numpy", Version: "1.25.0"}, true},
+		{RepodataRecord{Name: "openssl", Version: "3.1.2"}, true},
+		{RepodataRecord{Name: "openssl", Version: "1.1.1v"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.record.Name+"-"+tc.record.Version, func(t *testing.T) {
+			assert.Equal(t, tc.expected, l.Matches(&tc.record))
+		})
+	}
+}
+
+func TestPackageListPatterns(t *testing.T) {
+	l := newTestPackageList(t, "r-base", "r-* >=4", "re:^jupyterlab-.*$", "ros-humble-*")
+
+	assert.Equal(t, 4, l.Len())
+	assert.ElementsMatch(t, []string{"r-base"}, *l.Names().Items())
+
+	assert.True(t, l.ContainsName("r-ggplot2"))
+	assert.True(t, l.ContainsName("jupyterlab-git"))
+	assert.False(t, l.ContainsName("jupyterlab"))
+	assert.Equal(t, 2, len(l.Specs("r-base")))
+
+	assert.True(t, l.Matches(&RepodataRecord{Name: "r-base", Version: "3.6"}))
+	assert.False(t, l.Matches(&RepodataRecord{Name: "r-ggplot2", Version: "3.4"}))
+	assert.True(t, l.Matches(&RepodataRecord{Name: "r-ggplot2", Version: "4.0"}))
+	assert.True(t, l.Matches(&RepodataRecord{Name: "ros-humble-rclpy", Version: "3.3.9"}))
+	assert.False(t, l.Matches(&RepodataRecord{Name: "ros-iron-rclpy", Version: "3.3.9"}))
+
+	candidates := NewSet(&[]string{"r-base", "r-ggplot2", "jupyterlab", "jupyterlab-git", "python"})
+	assert.ElementsMatch(t, []string{"r-base", "r-ggplot2", "jupyterlab-git"}, *l.MatchingNames(candidates).Items())
+}
+
+func TestPackageListPatternsConcurrent(t *testing.T) {
+	l := newTestPackageList(t, "r-* >=4", "re:^jupyterlab-.*$")
+
+	// Run with -race to check the pattern cache
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				name := fmt.Sprintf("r-%d", j%(i+1))
+				assert.True(t, l.Matches(&RepodataRecord{Name: name, Version: "4.1"}))
+				assert.False(t, l.ContainsName(fmt.Sprintf("python-%d", j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestPackageListMatchesPinned(t *testing.T) {
+	l := newTestPackageList(t, "foo", "numpy", "numpy 1.21.*", "pytorch * *cuda*")
+
+	assert.False(t, l.MatchesPinned(&RepodataRecord{Name: "foo", Version: "1.0"}))
+	assert.True(t, l.MatchesPinned(&RepodataRecord{Name: "numpy", Version: "1.21.6"}))
+	assert.False(t, l.MatchesPinned(&RepodataRecord{Name: "numpy", Version: "1.25.0"}))
+	assert.True(t, l.MatchesPinned(&RepodataRecord{Name: "pytorch", Version: "2.1.0", Build: "cuda118_py310"}))
+	assert.False(t, l.MatchesPinned(&RepodataRecord{Name: "pytorch", Version: "2.1.0", Build: "cpu_py310"}))
+}
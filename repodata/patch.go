@@ -0,0 +1,149 @@
+// Repodata patch instructions
+// https://github.com/conda-forge/conda-forge-repodata-patches-feedstock
+package repodata
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Actions applied by patch instructions
+const (
+	PatchUpdated = "updated"
+	PatchRemoved = "removed"
+	PatchRevoked = "revoked"
+)
+
+// PatchInstructions are modifications to a subdir's repodata, in the same
+// format as conda-forge's patch_instructions.json
+type PatchInstructions struct {
+	PatchInstructionsVersion int `json:"patch_instructions_version"`
+	// Maps a filename to the fields to update, a null value deletes the field
+	Packages      map[string]map[string]interface{} `json:"packages"`
+	PackagesConda map[string]map[string]interface{} `json:"packages.conda"`
+	// Filenames to remove from the repodata, they're added to Repodata.Removed
+	Remove []string `json:"remove"`
+	// Filenames that can't be installed, they're given an unsatisfiable dependency
+	Revoke []string `json:"revoke"`
+}
+
+// AppliedPatch is a change made to a record by PatchInstructions
+type AppliedPatch struct {
+	Filename string
+	Action   string
+}
+
+// LoadPatchInstructions loads a patch_instructions.json file
+func LoadPatchInstructions(filename string) (*PatchInstructions, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var p PatchInstructions
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// patchRecord updates the fields of a record, a nil value deletes the field
+func patchRecord(record RepodataRecord, patch map[string]interface{}) (RepodataRecord, error) {
+	data, err := record.MarshalJSON()
+	if err != nil {
+		return record, err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return record, err
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(fields, k)
+		} else {
+			fields[k] = v
+		}
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		return record, err
+	}
+	patched := RepodataRecord{}
+	err = patched.UnmarshalJSON(data)
+	return patched, err
+}
+
+// condaFilename returns the .conda filename corresponding to a .tar.bz2 filename,
+// or an empty string
+func condaFilename(filename string) string {
+	if !strings.HasSuffix(filename, ".tar.bz2") {
+		return ""
+	}
+	return strings.TrimSuffix(filename, ".tar.bz2") + ".conda"
+}
+
+// Apply applies the patch instructions to repodata
+//
+// As in conda, a .tar.bz2 filename in the instructions also applies to the
+// .conda package with the same name. Returns the changes that were made.
+func (p *PatchInstructions) Apply(repodata *Repodata) ([]AppliedPatch, error) {
+	applied := []AppliedPatch{}
+
+	update := func(packages map[string]RepodataRecord, filename string, patch map[string]interface{}) error {
+		record, ok := packages[filename]
+		if !ok {
+			return nil
+		}
+		patched, err := patchRecord(record, patch)
+		if err != nil {
+			return err
+		}
+		packages[filename] = patched
+		applied = append(applied, AppliedPatch{filename, PatchUpdated})
+		return nil
+	}
+	for filename, patch := range p.Packages {
+		if err := update(repodata.Packages, filename, patch); err != nil {
+			return nil, err
+		}
+		if conda := condaFilename(filename); conda != "" {
+			if err := update(repodata.PackagesConda, conda, patch); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for filename, patch := range p.PackagesConda {
+		if err := update(repodata.PackagesConda, filename, patch); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, filename := range p.Revoke {
+		for _, f := range []string{filename, condaFilename(filename)} {
+			for _, packages := range []map[string]RepodataRecord{repodata.Packages, repodata.PackagesConda} {
+				if record, ok := packages[f]; ok {
+					if record.Extra == nil {
+						record.Extra = make(map[string]interface{})
+					}
+					record.Extra["revoked"] = true
+					record.Depends = append(append([]string{}, record.Depends...), "package_has_been_revoked")
+					packages[f] = record
+					applied = append(applied, AppliedPatch{f, PatchRevoked})
+				}
+			}
+		}
+	}
+
+	for _, filename := range p.Remove {
+		for _, f := range []string{filename, condaFilename(filename)} {
+			for _, packages := range []map[string]RepodataRecord{repodata.Packages, repodata.PackagesConda} {
+				if _, ok := packages[f]; ok {
+					delete(packages, f)
+					repodata.Removed = append(repodata.Removed, f)
+					applied = append(applied, AppliedPatch{f, PatchRemoved})
+				}
+			}
+		}
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,68 @@
+package repodata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatchInstructionsApply(t *testing.T) {
+	patches, err := LoadPatchInstructions(writeTestdataToTmpfile(t, "noarch/patch_instructions.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	repodata := loadTestdataRepodata(t, "noarch/repodata.json")
+
+	applied, err := patches.Apply(repodata)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.ElementsMatch(t, []AppliedPatch{
+		{"a-0.2.0-abc_0.tar.bz2", PatchUpdated},
+		{"b-1-10.tar.bz2", PatchUpdated},
+		{"c-1.2.3-aaa_0.conda", PatchRevoked},
+		{"a-0.1.0-0.tar.bz2", PatchRemoved},
+	}, applied)
+
+	a := repodata.Packages["a-0.2.0-abc_0.tar.bz2"]
+	assert.Equal(t, []string{"b 1.*", "c >=1", "d"}, a.Depends)
+	assert.Equal(t, "MIT", a.Extra["license"])
+	assert.Equal(t, "abc_0", a.Build)
+
+	assert.Nil(t, repodata.Packages["b-1-10.tar.bz2"].Depends)
+
+	c := repodata.PackagesConda["c-1.2.3-aaa_0.conda"]
+	assert.Equal(t, []string{"package_has_been_revoked"}, c.Depends)
+	assert.Equal(t, true, c.Extra["revoked"])
+
+	assert.NotContains(t, repodata.Packages, "a-0.1.0-0.tar.bz2")
+	assert.Equal(t, []string{"a-0.1.0-0.tar.bz2"}, repodata.Removed)
+}
+
+func TestPatchInstructionsApplyConda(t *testing.T) {
+	repodata := &Repodata{
+		Packages: map[string]RepodataRecord{
+			"a-1-0.tar.bz2": {Name: "a", Version: "1", Build: "0", Depends: []string{"b"}},
+		},
+		PackagesConda: map[string]RepodataRecord{
+			"a-1-0.conda": {Name: "a", Version: "1", Build: "0", Depends: []string{"b"}},
+			"a-2-0.conda": {Name: "a", Version: "2", Build: "0", Depends: []string{"b"}},
+		},
+	}
+	patches := &PatchInstructions{
+		Packages:      map[string]map[string]interface{}{"a-1-0.tar.bz2": {"depends": []string{"b <2"}}},
+		PackagesConda: map[string]map[string]interface{}{"a-2-0.conda": {"depends": []string{"b <3"}}},
+		Remove:        []string{"a-2-0.conda"},
+	}
+
+	applied, err := patches.Apply(repodata)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, 4, len(applied))
+	// .tar.bz2 patches also apply to .conda
+	assert.Equal(t, []string{"b <2"}, repodata.Packages["a-1-0.tar.bz2"].Depends)
+	assert.Equal(t, []string{"b <2"}, repodata.PackagesConda["a-1-0.conda"].Depends)
+	assert.NotContains(t, repodata.PackagesConda, "a-2-0.conda")
+	assert.Equal(t, []string{"a-2-0.conda"}, repodata.Removed)
+}
@@ -0,0 +1,240 @@
+// Policy rules for filtering repodata records
+package repodata
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rules that can exclude a record from the filtered repodata
+const (
+	RuleInvalidFilename = "invalid-filename"
+	RuleNotAllowed      = "not-allowed"
+	RuleDenied          = "denied"
+	RuleBuild           = "build"
+	RuleSize            = "size"
+	RuleMinAge          = "min-age"
+	RuleLicense         = "license"
+	RuleAdvisory        = "advisory"
+	RuleVirtualPackage  = "virtual-package"
+	RuleRetention       = "retention"
+	RulePreferConda     = "prefer-conda"
+	// Used for dependencies that don't match any records
+	RuleNotFound = "not-found"
+)
+
+// FilterPolicy holds the rules used to filter a channel's repodata
+type FilterPolicy struct {
+	// Allowed packages, nil to allow all packages
+	Allowed *PackageList
+	// Additional allowed filenames including the subdir, e.g. from dependency recursion
+	AllowedFiles *Set
+	// Filenames including the subdir from lockfiles, these are allowed and are
+	// always kept by the retention policy
+	LockedFiles *Set
+	// Denied packages, these are excluded even if they are allowed
+	Denied *PackageList
+	// Build string and track_features filters, nil to allow all builds
+	Builds *BuildPolicy
+	// Package size limits, nil to allow all sizes
+	Sizes *SizePolicy
+
+	// Records uploaded more recently than this are excluded, 0 to disable
+	MinAge time.Duration
+	// Packages that are exempt from MinAge
+	MinAgeExempt *PackageList
+	// Current time used for MinAge, zero to use time.Now()
+	Now time.Time
+
+	// License policy, nil to allow all licenses
+	License *LicensePolicy
+
+	// Vulnerability advisories, records affected by an advisory are excluded
+	Advisories *AdvisoryDatabase
+
+	// Virtual package profiles indexed by subdir, records with virtual package
+	// dependencies that aren't satisfied by the profile for their subdir are
+	// excluded. noarch records are served with every platform subdir, they're
+	// excluded if they aren't satisfied by any of the platform profiles, or by
+	// the noarch profile if there is one.
+	VirtualPackages map[string]*VirtualPackageProfile
+
+	// Retention policy for old versions, nil to keep all versions. Versions
+	// pinned in Allowed and LockedFiles are always kept.
+	Retention *RetentionPolicy
+
+	// Exclude .tar.bz2 records if the same package is available as .conda,
+	// unless the .tar.bz2 is in LockedFiles
+	PreferConda bool
+}
+
+// allowsFile returns true if a filename including the subdir is in AllowedFiles or LockedFiles
+func (p *FilterPolicy) allowsFile(filename string) bool {
+	return (p.AllowedFiles != nil && p.AllowedFiles.Contains(filename)) || (p.LockedFiles != nil && p.LockedFiles.Contains(filename))
+}
+
+// now returns the current time used by the policy
+func (p *FilterPolicy) now() time.Time {
+	if p.Now.IsZero() {
+		return time.Now()
+	}
+	return p.Now
+}
+
+// Exclusion is a record that was removed from the filtered repodata
+type Exclusion struct {
+	Filename string
+	Record   RepodataRecord
+	// Rule that excluded the record
+	Rule string
+	// Reason for the exclusion, e.g. the matching denylist entry
+	Reason string
+}
+
+// packageIsDenied returns the denylist MatchSpec matching the record, or nil
+func packageIsDenied(record *RepodataRecord, deniedPackages *PackageList) *MatchSpec {
+	if deniedPackages == nil {
+		return nil
+	}
+	return deniedPackages.MatchingSpec(record)
+}
+
+// RecordTimestamp returns the upload time of a record, and false if it's not known
+func RecordTimestamp(record *RepodataRecord) (time.Time, bool) {
+	value, ok := record.Extra["timestamp"].(float64)
+	if !ok || value <= 0 {
+		return time.Time{}, false
+	}
+	// Older records use seconds, newer records use milliseconds
+	if value > 253402300799 {
+		return time.UnixMilli(int64(value)), true
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// packageIsTooNew returns the upload time of the record if it is newer than
+// the policy's MinAge and isn't exempt
+func packageIsTooNew(record *RepodataRecord, policy *FilterPolicy) (time.Time, bool) {
+	if policy.MinAge <= 0 {
+		return time.Time{}, false
+	}
+	uploaded, ok := RecordTimestamp(record)
+	if !ok {
+		return time.Time{}, false
+	}
+	if policy.now().Sub(uploaded) >= policy.MinAge {
+		return time.Time{}, false
+	}
+	if policy.MinAgeExempt != nil && policy.MinAgeExempt.Matches(record) {
+		return time.Time{}, false
+	}
+	return uploaded, true
+}
+
+// checkRecord checks a record against the policy
+//
+// filename must include the subdir. Returns the rule that excluded the record
+// and a reason, or an empty rule if the record is allowed. A nil policy allows
+// everything.
+func checkRecord(filename string, record *RepodataRecord, policy *FilterPolicy) (string, string) {
+	if policy == nil {
+		return "", ""
+	}
+	if !packageIsAllowed(record, policy.Allowed) && !policy.allowsFile(filename) {
+		return RuleNotAllowed, ""
+	}
+	return checkRecordRules(filename, record, policy)
+}
+
+// CheckRules checks a record against all rules in the policy apart from the
+// allowlist and retention policy
+//
+// filename must include the subdir. Returns the rule that excluded the record
+// and a reason, or an empty rule if the record is allowed.
+func (p *FilterPolicy) CheckRules(filename string, record *RepodataRecord) (string, string) {
+	return checkRecordRules(filename, record, p)
+}
+
+// checkRecordRules checks a record against all rules in the policy apart from
+// the allowlist
+func checkRecordRules(filename string, record *RepodataRecord, policy *FilterPolicy) (string, string) {
+	return checkRules(filename, record, policy, true)
+}
+
+// checkRules checks a record against all rules in the policy apart from the
+// allowlist, and apart from the denylist if denylist is false
+func checkRules(filename string, record *RepodataRecord, policy *FilterPolicy, denylist bool) (string, string) {
+	if policy == nil {
+		return "", ""
+	}
+	// Advisories are checked first so affected files are always reported as
+	// blocked, even if another rule also excludes them
+	if policy.Advisories != nil {
+		if ids := policy.Advisories.Check(record); len(ids) > 0 {
+			return RuleAdvisory, strings.Join(ids, ",")
+		}
+	}
+	if denylist {
+		if spec := packageIsDenied(record, policy.Denied); spec != nil {
+			return RuleDenied, spec.String()
+		}
+	}
+	if policy.Builds != nil {
+		if ok, reason := policy.Builds.Check(record); !ok {
+			return RuleBuild, reason
+		}
+	}
+	if policy.Sizes != nil {
+		if ok, reason := policy.Sizes.Check(record); !ok {
+			return RuleSize, reason
+		}
+	}
+	if uploaded, tooNew := packageIsTooNew(record, policy); tooNew {
+		return RuleMinAge, fmt.Sprintf("uploaded %s", uploaded.UTC().Format(time.RFC3339))
+	}
+	if policy.License != nil {
+		license, _ := record.Extra["license"].(string)
+		if ok, reason := policy.License.Check(license); !ok {
+			return RuleLicense, reason
+		}
+	}
+	if reason := checkVirtualPackages(record, policy.VirtualPackages); reason != "" {
+		return RuleVirtualPackage, reason
+	}
+	return "", ""
+}
+
+// checkVirtualPackages returns a reason if the record's virtual package
+// dependencies aren't satisfied by the profiles, or an empty string
+func checkVirtualPackages(record *RepodataRecord, profiles map[string]*VirtualPackageProfile) string {
+	if profile, ok := profiles[record.Subdir]; ok {
+		if dep := profile.Check(record); dep != "" {
+			return "requires " + dep
+		}
+	}
+	if record.Subdir != "noarch" {
+		return ""
+	}
+
+	platforms := []string{}
+	for subdir := range profiles {
+		if subdir != "noarch" {
+			platforms = append(platforms, subdir)
+		}
+	}
+	sort.Strings(platforms)
+	unsatisfied := []string{}
+	for _, subdir := range platforms {
+		dep := profiles[subdir].Check(record)
+		if dep == "" {
+			return ""
+		}
+		unsatisfied = append(unsatisfied, dep+" ("+subdir+")")
+	}
+	if len(unsatisfied) == 0 {
+		return ""
+	}
+	return "requires " + strings.Join(unsatisfied, ", ")
+}
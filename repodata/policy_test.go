@@ -0,0 +1,246 @@
+package repodata
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordTimestamp(t *testing.T) {
+	testCases := []struct {
+		name     string
+		extra    map[string]interface{}
+		expected time.Time
+		ok       bool
+	}{
+		{"milliseconds", map[string]interface{}{"timestamp": float64(1691193600000)}, time.Unix(1691193600, 0), true},
+		{"seconds", map[string]interface{}{"timestamp": float64(1691193600)}, time.Unix(1691193600, 0), true},
+		{"missing", map[string]interface{}{}, time.Time{}, false},
+		{"invalid", map[string]interface{}{"timestamp": "yesterday"}, time.Time{}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts, ok := RecordTimestamp(&RepodataRecord{Extra: tc.extra})
+			assert.Equal(t, tc.ok, ok)
+			assert.True(t, tc.expected.Equal(ts))
+		})
+	}
+}
+
+func TestCheckRecordMinAge(t *testing.T) {
+	now := time.Date(2023, 8, 10, 0, 0, 0, 0, time.UTC)
+	policy := &FilterPolicy{
+		MinAge:       7 * 24 * time.Hour,
+		MinAgeExempt: newTestPackageList(t, "openssl"),
+		Now:          now,
+	}
+
+	newRecord := func(name string, uploaded time.Time) *RepodataRecord {
+		return &RepodataRecord{
+			Name:    name,
+			Version: "1",
+			Extra:   map[string]interface{}{"timestamp": float64(uploaded.UnixMilli())},
+		}
+	}
+
+	testCases := []struct {
+		name   string
+		record *RepodataRecord
+		rule   string
+		reason string
+	}{
+		{"old", newRecord("foo", now.Add(-8*24*time.Hour)), "", ""},
+		{"new", newRecord("foo", now.Add(-2*24*time.Hour)), RuleMinAge, "uploaded 2023-08-08T00:00:00Z"},
+		{"exempt", newRecord("openssl", now.Add(-2*24*time.Hour)), "", ""},
+		{"no timestamp", &RepodataRecord{Name: "foo", Version: "1"}, "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, reason := checkRecord("noarch/test", tc.record, policy)
+			assert.Equal(t, tc.rule, rule)
+			assert.Equal(t, tc.reason, reason)
+		})
+	}
+}
+
+func TestCheckRecord(t *testing.T) {
+	policy := &FilterPolicy{
+		Allowed: newTestPackageList(t, "foo", "bar"),
+		Denied:  newTestPackageList(t, "bar <2"),
+	}
+
+	testCases := []struct {
+		record RepodataRecord
+		rule   string
+		reason string
+	}{
+		{RepodataRecord{Name: "foo", Version: "1"}, "", ""},
+		{RepodataRecord{Name: "baz", Version: "1"}, RuleNotAllowed, ""},
+		{RepodataRecord{Name: "bar", Version: "1"}, RuleDenied, "bar <2"},
+		{RepodataRecord{Name: "bar", Version: "2"}, "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.record.Name+"-"+tc.record.Version, func(t *testing.T) {
+			rule, reason := checkRecord("noarch/test", &tc.record, policy)
+			assert.Equal(t, tc.rule, rule)
+			assert.Equal(t, tc.reason, reason)
+		})
+	}
+
+	rule, _ := checkRecord("noarch/test", &RepodataRecord{Name: "baz"}, nil)
+	assert.Equal(t, "", rule)
+}
+
+func TestFilterPolicyCheckRules(t *testing.T) {
+	policy := &FilterPolicy{Allowed: newTestPackageList(t, "a"), Denied: newTestPackageList(t, "b")}
+
+	rule, reason := policy.CheckRules("noarch/b", &RepodataRecord{Name: "b"})
+	assert.Equal(t, RuleDenied, rule)
+	assert.Equal(t, "b", reason)
+
+	// The allowlist isn't checked
+	rule, _ = policy.CheckRules("noarch/c", &RepodataRecord{Name: "c"})
+	assert.Equal(t, "", rule)
+}
+
+func TestCheckRecordBuild(t *testing.T) {
+	builds, err := NewBuildPolicy([]string{"*cuda*"}, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy := &FilterPolicy{Builds: builds}
+
+	rule, reason := checkRecord("linux-64/a", &RepodataRecord{Name: "a", Build: "cuda120_0"}, policy)
+	assert.Equal(t, RuleBuild, rule)
+	assert.Equal(t, "build string cuda120_0 matches *cuda*", reason)
+
+	rule, reason = checkRecord("linux-64/a", &RepodataRecord{Name: "a", Build: "cpu_0"}, policy)
+	assert.Equal(t, "", rule)
+	assert.Equal(t, "", reason)
+}
+
+func TestCheckRecordSize(t *testing.T) {
+	sizes, err := NewSizePolicy(1, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy := &FilterPolicy{Sizes: sizes}
+
+	rule, reason := checkRecord("linux-64/a", &RepodataRecord{Name: "a", Size: 3 * megabyte / 2}, policy)
+	assert.Equal(t, RuleSize, rule)
+	assert.Equal(t, "size 1.5 MB > 1 MB", reason)
+
+	rule, reason = checkRecord("linux-64/a", &RepodataRecord{Name: "a", Size: megabyte}, policy)
+	assert.Equal(t, "", rule)
+	assert.Equal(t, "", reason)
+}
+
+func TestCheckRecordLicense(t *testing.T) {
+	license, err := NewLicensePolicy(nil, false, []string{"AGPL-3.0-only"}, "deny")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy := &FilterPolicy{License: license}
+
+	rule, reason := checkRecord("noarch/test", &RepodataRecord{Name: "a", Extra: map[string]interface{}{"license": "MIT"}}, policy)
+	assert.Equal(t, "", rule)
+	assert.Equal(t, "", reason)
+
+	rule, reason = checkRecord("noarch/test", &RepodataRecord{Name: "b", Extra: map[string]interface{}{"license": "AGPL-3.0-only"}}, policy)
+	assert.Equal(t, RuleLicense, rule)
+	assert.Equal(t, "license not allowed: AGPL-3.0-only", reason)
+
+	rule, reason = checkRecord("noarch/test", &RepodataRecord{Name: "c"}, policy)
+	assert.Equal(t, RuleLicense, rule)
+	assert.Equal(t, "missing license", reason)
+}
+
+func TestCheckRecordAdvisory(t *testing.T) {
+	db, err := LoadAdvisoryDatabase("testdata/advisories", "testdata")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy := &FilterPolicy{Advisories: db}
+
+	rule, reason := checkRecord("noarch/test", &RepodataRecord{Name: "b", Version: "1.0"}, policy)
+	assert.Equal(t, RuleAdvisory, rule)
+	assert.Equal(t, "CONDA-2023-0001", reason)
+
+	rule, reason = checkRecord("noarch/test", &RepodataRecord{Name: "b", Version: "1.2"}, policy)
+	assert.Equal(t, "", rule)
+	assert.Equal(t, "", reason)
+
+	// Advisories take precedence over other rules so the blocked file is reported
+	policy.Denied = newTestPackageList(t, "b")
+	sizes, err := NewSizePolicy(1, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy.Sizes = sizes
+	rule, reason = checkRecord("noarch/test", &RepodataRecord{Name: "b", Version: "1.0", Size: 2 * megabyte}, policy)
+	assert.Equal(t, RuleAdvisory, rule)
+	assert.Equal(t, "CONDA-2023-0001", reason)
+
+	rule, _ = checkRecord("noarch/test", &RepodataRecord{Name: "b", Version: "1.2", Size: 2 * megabyte}, policy)
+	assert.Equal(t, RuleDenied, rule)
+}
+
+func TestCheckRecordVirtualPackages(t *testing.T) {
+	profile, err := NewVirtualPackageProfile(map[string]string{"__glibc": "2.17"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy := &FilterPolicy{VirtualPackages: map[string]*VirtualPackageProfile{"linux-64": profile}}
+	depends := []string{"__glibc >=2.28"}
+
+	rule, reason := checkRecord("linux-64/a", &RepodataRecord{Subdir: "linux-64", Name: "a", Depends: depends}, policy)
+	assert.Equal(t, RuleVirtualPackage, rule)
+	assert.Equal(t, "requires __glibc >=2.28", reason)
+
+	// Profiles only apply to their own subdir
+	rule, reason = checkRecord("osx-64/a", &RepodataRecord{Subdir: "osx-64", Name: "a", Depends: depends}, policy)
+	assert.Equal(t, "", rule)
+	assert.Equal(t, "", reason)
+}
+
+func TestCheckRecordVirtualPackagesNoarch(t *testing.T) {
+	profiles, err := NewPlatformVirtualPackageProfiles(
+		[]string{"linux-64", "win-64", "noarch"},
+		map[string]map[string]string{"linux-64": {"__glibc": "2.17"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy := &FilterPolicy{VirtualPackages: profiles}
+
+	testCases := []struct {
+		depends []string
+		rule    string
+		reason  string
+	}{
+		{[]string{"python"}, "", ""},
+		// Installable on one of the platforms
+		{[]string{"__unix"}, "", ""},
+		{[]string{"__win"}, "", ""},
+		{[]string{"__glibc >=2.28"}, RuleVirtualPackage, "requires __glibc >=2.28 (linux-64), __glibc >=2.28 (win-64)"},
+		{[]string{"__unix", "__glibc >=2.28"}, RuleVirtualPackage, "requires __glibc >=2.28 (linux-64), __unix (win-64)"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprint(tc.depends), func(t *testing.T) {
+			rule, reason := checkRecord("noarch/a", &RepodataRecord{Subdir: "noarch", Name: "a", Depends: tc.depends}, policy)
+			assert.Equal(t, tc.rule, rule)
+			assert.Equal(t, tc.reason, reason)
+		})
+	}
+
+	// A linux-only channel drops noarch packages for other platforms
+	profiles, err = NewPlatformVirtualPackageProfiles([]string{"linux-64", "noarch"}, map[string]map[string]string{"linux-64": {}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	rule, reason := checkRecord("noarch/a", &RepodataRecord{Subdir: "noarch", Name: "a", Depends: []string{"__win"}}, &FilterPolicy{VirtualPackages: profiles})
+	assert.Equal(t, RuleVirtualPackage, rule)
+	assert.Equal(t, "requires __win (linux-64)", reason)
+}
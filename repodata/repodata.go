@@ -37,6 +37,9 @@ type RepodataRecord struct {
 
 type RepodataInfo struct {
 	Subdir string `json:"subdir"`
+
+	// Extra fields such as base_url, keep so we can serialise back to JSON
+	Extra map[string]interface{} `json:"-"`
 }
 
 // https://github.com/conda/schemas/blob/bd2b05d6a6314b39d9a8c9c9802280c3eb78e788/repodata-1.schema.json
@@ -48,6 +51,11 @@ type Repodata struct {
 	Packages map[string]RepodataRecord `json:"packages"`
 	// ^.+\.conda$
 	PackagesConda map[string]RepodataRecord `json:"packages.conda"`
+	// Filenames of packages that have been removed (yanked)
+	Removed []string `json:"removed,omitempty"`
+
+	// Extra fields, keep so we can serialise back to JSON
+	Extra map[string]interface{} `json:"-"`
 }
 
 // EncodeJSON converts a value to a JSON byte array, without escaping HTML
@@ -62,25 +70,37 @@ func EncodeJSON(v any, indent string) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-type _RepodataRecord RepodataRecord
+// jsonFieldName returns the JSON key of a struct field and whether it has
+// omitempty, or an empty string if it doesn't have a json tag
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := strings.Split(field.Tag.Get("json"), ",")
+	if tag[0] == "-" {
+		return "", false
+	}
+	omitEmpty := false
+	for _, option := range tag[1:] {
+		omitEmpty = omitEmpty || option == "omitempty"
+	}
+	return tag[0], omitEmpty
+}
 
-// MarshalJSON marshals a RepodataRecord to JSON, including Extra fields
-func (t RepodataRecord) MarshalJSON() ([]byte, error) {
+// marshalWithExtra marshals the struct v to a JSON object containing all fields
+// in extra and all struct fields with a json tag
+func marshalWithExtra(v any, extra map[string]interface{}) ([]byte, error) {
 	data := make(map[string]interface{})
 
 	// Take everything in Extra
-	for k, v := range t.Extra {
+	for k, v := range extra {
 		data[k] = v
 	}
 
 	// Take all the struct values with a json tag
-	val := reflect.ValueOf(t)
-	typ := reflect.TypeOf(t)
+	val := reflect.ValueOf(v)
+	typ := val.Type()
 	for i := 0; i < typ.NumField(); i++ {
-		field := typ.Field(i)
 		fieldv := val.Field(i)
-		jsonTag := strings.Split(field.Tag.Get("json"), ",")[0]
-		if jsonTag != "" && jsonTag != "-" {
+		jsonTag, omitEmpty := jsonFieldName(typ.Field(i))
+		if jsonTag != "" && !(omitEmpty && fieldv.IsZero()) {
 			data[jsonTag] = fieldv.Interface()
 		}
 	}
@@ -88,30 +108,98 @@ func (t RepodataRecord) MarshalJSON() ([]byte, error) {
 	return EncodeJSON(data, " ")
 }
 
+// unmarshalWithExtra unmarshals a JSON object into the struct pointed to by v,
+// and returns all other fields
+//
+// The object is only decoded once, into raw values, and each struct field is
+// unmarshalled from its raw value.
+//
+// v must not implement json.Unmarshaler, use a type alias.
+func unmarshalWithExtra(b []byte, v any) (map[string]interface{}, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	val := reflect.ValueOf(v).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		jsonTag, _ := jsonFieldName(typ.Field(i))
+		r, ok := raw[jsonTag]
+		if jsonTag == "" || !ok {
+			continue
+		}
+		if err := json.Unmarshal(r, val.Field(i).Addr().Interface()); err != nil {
+			return nil, err
+		}
+		delete(raw, jsonTag)
+	}
+
+	extra := make(map[string]interface{})
+	for k, r := range raw {
+		var value interface{}
+		if err := json.Unmarshal(r, &value); err != nil {
+			return nil, err
+		}
+		extra[k] = value
+	}
+	return extra, nil
+}
+
+type _RepodataRecord RepodataRecord
+
+// MarshalJSON marshals a RepodataRecord to JSON, including Extra fields
+func (t RepodataRecord) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(t, t.Extra)
+}
+
 // UnmarshalJSON unmarshals a RepodataRecord from JSON, including Extra fields
 func (t *RepodataRecord) UnmarshalJSON(b []byte) error {
 	t2 := _RepodataRecord{}
-	err := json.Unmarshal(b, &t2)
+	extra, err := unmarshalWithExtra(b, &t2)
 	if err != nil {
 		return err
 	}
+	t2.Extra = extra
+	*t = RepodataRecord(t2)
+	return nil
+}
+
+type _RepodataInfo RepodataInfo
+
+// MarshalJSON marshals a RepodataInfo to JSON, including Extra fields
+func (t RepodataInfo) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(t, t.Extra)
+}
 
-	err = json.Unmarshal(b, &(t2.Extra))
+// UnmarshalJSON unmarshals a RepodataInfo from JSON, including Extra fields
+func (t *RepodataInfo) UnmarshalJSON(b []byte) error {
+	t2 := _RepodataInfo{}
+	extra, err := unmarshalWithExtra(b, &t2)
 	if err != nil {
 		return err
 	}
+	t2.Extra = extra
+	*t = RepodataInfo(t2)
+	return nil
+}
 
-	typ := reflect.TypeOf(t2)
-	for i := 0; i < typ.NumField(); i++ {
-		field := typ.Field(i)
-		jsonTag := strings.Split(field.Tag.Get("json"), ",")[0]
-		if jsonTag != "" && jsonTag != "-" {
-			delete(t2.Extra, jsonTag)
-		}
-	}
+type _Repodata Repodata
 
-	*t = RepodataRecord(t2)
+// MarshalJSON marshals Repodata to JSON, including Extra fields
+func (t Repodata) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(t, t.Extra)
+}
 
+// UnmarshalJSON unmarshals Repodata from JSON, including Extra fields
+func (t *Repodata) UnmarshalJSON(b []byte) error {
+	t2 := _Repodata{}
+	extra, err := unmarshalWithExtra(b, &t2)
+	if err != nil {
+		return err
+	}
+	t2.Extra = extra
+	*t = Repodata(t2)
 	return nil
 }
 
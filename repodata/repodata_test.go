@@ -82,3 +82,82 @@ func TestRepodataJSON(t *testing.T) {
 	assert.Equal(t, "penguin", r.PackagesConda["penguin-2.conda"].Name)
 	assert.Equal(t, "2", r.PackagesConda["penguin-2.conda"].Version)
 }
+
+func TestRepodataJSONExtra(t *testing.T) {
+	repodataBytes := []byte(`{
+		"repodata_version": 1,
+		"info": {"subdir": "noarch", "base_url": "https://example.org/channel/noarch"},
+		"packages": {
+			"penguin-1-0.tar.bz2": {"name": "penguin", "version": "1", "build": "0", "subdir": "noarch", "license": "MIT"}
+		},
+		"packages.conda": {},
+		"removed": ["penguin-0.1-0.tar.bz2"],
+		"future_field": {"a": [1, 2]}
+	}`)
+
+	r := &Repodata{}
+	if err := json.Unmarshal(repodataBytes, r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, map[string]interface{}{"base_url": "https://example.org/channel/noarch"}, r.Info.Extra)
+	assert.Equal(t, []string{"penguin-0.1-0.tar.bz2"}, r.Removed)
+	assert.Equal(t, map[string]interface{}{"future_field": map[string]interface{}{"a": []interface{}{float64(1), float64(2)}}}, r.Extra)
+	assert.Equal(t, "MIT", r.Packages["penguin-1-0.tar.bz2"].Extra["license"])
+
+	rawBytes, err := EncodeJSON(r, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	s := &Repodata{}
+	if err := json.Unmarshal(rawBytes, s); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, r, s)
+
+	// Removed is omitted if it wasn't in the original repodata
+	rawBytes, err = EncodeJSON(Repodata{}, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.NotContains(t, string(rawBytes), "removed")
+}
+
+func TestRepodataRecordJSONExtra(t *testing.T) {
+	r := &RepodataRecord{}
+	err := json.Unmarshal([]byte(` { "name" :"a\"}" , "depends":["b >=1,<2", "c"],"n":-1.5e3,"x":{"y":[{}, []]},"t":true,"z":null } `), r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, `a"}`, r.Name)
+	assert.Equal(t, []string{"b >=1,<2", "c"}, r.Depends)
+	assert.Equal(t, map[string]interface{}{
+		"n": -1500.0,
+		"x": map[string]interface{}{"y": []interface{}{map[string]interface{}{}, []interface{}{}}},
+		"t": true,
+		"z": nil,
+	}, r.Extra)
+
+	records := map[string]RepodataRecord{}
+	if err := json.Unmarshal([]byte(`{"a": {}, "b": null}`), &records); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, map[string]interface{}{}, records["a"].Extra)
+
+	for _, invalid := range []string{
+		``,
+		`[]`,
+		`{"name": "a"`,
+		`{"name": "a",}`,
+		`{"name" "a"}`,
+		`{"name": }`,
+		`{"name": "a" "b": 1}`,
+		`{"name": "a"} x`,
+		`{"name": 1}`,
+		`{"x": [1}`,
+		`{"x": tru}`,
+		`{name: "a"}`,
+	} {
+		err := json.Unmarshal([]byte(invalid), &RepodataRecord{})
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,139 @@
+// Retention policy for old package versions
+package repodata
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy limits the number of versions and builds kept for each package
+//
+// If both KeepVersions and KeepMonths are set a version is kept if it satisfies
+// either, so the newest versions are always kept even if they're old.
+type RetentionPolicy struct {
+	// Keep the newest N versions of each package, 0 to disable
+	KeepVersions int
+	// Keep versions first released in the last N months, 0 to disable
+	KeepMonths int
+	// Keep the newest N build numbers of each kept version, 0 to keep all builds
+	KeepBuilds int
+}
+
+// retentionVersion is a group of records with the same package name and version
+type retentionVersion struct {
+	records []*IndexedRecord
+	// Earliest upload time of the records, zero if not known
+	released time.Time
+}
+
+// groupVersions groups the records for a package by version, newest first
+func groupVersions(records []*IndexedRecord) []*retentionVersion {
+	sorted := append([]*IndexedRecord{}, records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if c := sorted[i].version.Compare(sorted[j].version); c != 0 {
+			return c > 0
+		}
+		return sorted[i].Record.BuildNumber > sorted[j].Record.BuildNumber
+	})
+
+	versions := []*retentionVersion{}
+	for _, r := range sorted {
+		n := len(versions)
+		if n == 0 || versions[n-1].records[0].version.Compare(r.version) != 0 {
+			versions = append(versions, &retentionVersion{})
+			n++
+		}
+		v := versions[n-1]
+		v.records = append(v.records, r)
+		if uploaded, ok := RecordTimestamp(&r.Record); ok && (v.released.IsZero() || uploaded.Before(v.released)) {
+			v.released = uploaded
+		}
+	}
+	return versions
+}
+
+// apply returns the filenames of the records that aren't retained, mapped to a reason
+//
+// Records matching a version or build constraint in pinned, or with a filename
+// in locked, are always kept.
+func (p *RetentionPolicy) apply(records []*IndexedRecord, pinned *PackageList, locked *Set, now time.Time) map[string]string {
+	removed := make(map[string]string)
+	if p.KeepVersions <= 0 && p.KeepMonths <= 0 && p.KeepBuilds <= 0 {
+		return removed
+	}
+	cutoff := now.AddDate(0, -p.KeepMonths, 0)
+
+	byName := make(map[string][]*IndexedRecord)
+	for _, r := range records {
+		byName[r.Record.Name] = append(byName[r.Record.Name], r)
+	}
+
+	for _, nameRecords := range byName {
+		for i, v := range groupVersions(nameRecords) {
+			reason := ""
+			newest := p.KeepVersions > 0 && i < p.KeepVersions
+			// Versions without an upload time are assumed to be recent
+			recent := p.KeepMonths > 0 && (v.released.IsZero() || !v.released.Before(cutoff))
+			if (p.KeepVersions > 0 || p.KeepMonths > 0) && !newest && !recent {
+				reasons := []string{}
+				if p.KeepVersions > 0 {
+					reasons = append(reasons, fmt.Sprintf("not in newest %d versions", p.KeepVersions))
+				}
+				if p.KeepMonths > 0 {
+					reasons = append(reasons, "released "+v.released.UTC().Format(time.RFC3339))
+				}
+				reason = strings.Join(reasons, ", ")
+			}
+
+			buildNumbers := 0
+			previous := 0
+			for j, r := range v.records {
+				if j == 0 || r.Record.BuildNumber != previous {
+					buildNumbers++
+					previous = r.Record.BuildNumber
+				}
+				recordReason := reason
+				if recordReason == "" && p.KeepBuilds > 0 && buildNumbers > p.KeepBuilds {
+					recordReason = fmt.Sprintf("build number %d not in newest %d builds", r.Record.BuildNumber, p.KeepBuilds)
+				}
+				if recordReason == "" || (pinned != nil && pinned.MatchesPinned(&r.Record)) || (locked != nil && locked.Contains(r.Filename)) {
+					continue
+				}
+				removed[r.Filename] = recordReason
+			}
+		}
+	}
+	return removed
+}
+
+// applyRetention removes the records that aren't retained by the policy's
+// retention policy from repodata, and returns them
+func applyRetention(repodata *Repodata, policy *FilterPolicy) []Exclusion {
+	exclusions := []Exclusion{}
+	if policy == nil || policy.Retention == nil {
+		return exclusions
+	}
+
+	records := []*IndexedRecord{}
+	for _, packages := range []map[string]RepodataRecord{repodata.Packages, repodata.PackagesConda} {
+		for k, v := range packages {
+			// Records with an invalid version can't be ordered so they're kept
+			if version, err := ParseVersion(v.Version); err == nil {
+				records = append(records, &IndexedRecord{Filename: v.Subdir + "/" + k, Record: v, version: version})
+			}
+		}
+	}
+
+	removed := policy.Retention.apply(records, policy.Allowed, policy.LockedFiles, policy.now())
+	for _, packages := range []map[string]RepodataRecord{repodata.Packages, repodata.PackagesConda} {
+		for k, v := range packages {
+			if reason, ok := removed[v.Subdir+"/"+k]; ok {
+				delete(packages, k)
+				exclusions = append(exclusions, Exclusion{k, v, RuleRetention, reason})
+			}
+		}
+	}
+	return exclusions
+}
@@ -0,0 +1,108 @@
+package repodata
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRetentionTestRecords(t *testing.T, now time.Time) []*IndexedRecord {
+	records := []*IndexedRecord{}
+	add := func(filename string, version string, buildNumber int, age time.Duration) {
+		v, err := ParseVersion(version)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		records = append(records, &IndexedRecord{
+			Filename: filename,
+			Record: RepodataRecord{
+				Name:        "a",
+				Version:     version,
+				BuildNumber: buildNumber,
+				Extra:       map[string]interface{}{"timestamp": float64(now.Add(-age).UnixMilli())},
+			},
+			version: v,
+		})
+	}
+	year := 365 * 24 * time.Hour
+	add("a-1.0-0", "1.0", 0, 3*year)
+	add("a-1.0-1", "1.0", 1, year/6)
+	add("a-1.10-0", "1.10", 0, 2*year)
+	add("a-2.0-py310_0", "2.0", 0, year/12)
+	add("a-2.0-py310_1", "2.0", 1, year/24)
+	add("a-2.0-py311_1", "2.0", 1, year/24)
+	return records
+}
+
+func TestRetentionPolicyApply(t *testing.T) {
+	now := time.Date(2023, 8, 10, 0, 0, 0, 0, time.UTC)
+	records := newRetentionTestRecords(t, now)
+
+	testCases := []struct {
+		policy   RetentionPolicy
+		pinned   []string
+		locked   *Set
+		expected []string
+	}{
+		{RetentionPolicy{}, nil, nil, []string{}},
+		{RetentionPolicy{KeepVersions: 2}, nil, nil, []string{"a-1.0-0", "a-1.0-1"}},
+		{RetentionPolicy{KeepVersions: 1}, []string{"a 1.0"}, nil, []string{"a-1.10-0"}},
+		{RetentionPolicy{KeepBuilds: 1}, nil, nil, []string{"a-1.0-0", "a-2.0-py310_0"}},
+		{RetentionPolicy{KeepVersions: 2, KeepBuilds: 1}, nil, nil, []string{"a-1.0-0", "a-1.0-1", "a-2.0-py310_0"}},
+		// Versions are released when their first build is uploaded
+		{RetentionPolicy{KeepMonths: 6}, nil, nil, []string{"a-1.0-0", "a-1.0-1", "a-1.10-0"}},
+		{RetentionPolicy{KeepVersions: 2, KeepMonths: 6}, nil, nil, []string{"a-1.0-0", "a-1.0-1"}},
+		{RetentionPolicy{KeepVersions: 1}, nil, NewSet(&[]string{"a-1.0-0"}), []string{"a-1.0-1", "a-1.10-0"}},
+		// Unconstrained entries don't pin a version
+		{RetentionPolicy{KeepVersions: 1}, []string{"a"}, nil, []string{"a-1.0-0", "a-1.0-1", "a-1.10-0"}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%+v,%v", tc.policy, tc.pinned), func(t *testing.T) {
+			var pinned *PackageList
+			if tc.pinned != nil {
+				pinned = newTestPackageList(t, tc.pinned...)
+			}
+			removed := tc.policy.apply(records, pinned, tc.locked, now)
+			filenames := []string{}
+			for filename := range removed {
+				filenames = append(filenames, filename)
+			}
+			assert.ElementsMatch(t, tc.expected, filenames)
+		})
+	}
+}
+
+func TestRetentionPolicyApplyReason(t *testing.T) {
+	now := time.Date(2023, 8, 10, 0, 0, 0, 0, time.UTC)
+	records := newRetentionTestRecords(t, now)
+
+	removed := (&RetentionPolicy{KeepVersions: 2, KeepBuilds: 1}).apply(records, nil, nil, now)
+	assert.Equal(t, "not in newest 2 versions", removed["a-1.0-1"])
+	assert.Equal(t, "build number 0 not in newest 1 builds", removed["a-2.0-py310_0"])
+
+	removed = (&RetentionPolicy{KeepMonths: 6}).apply(records, nil, nil, now)
+	assert.Equal(t, "released 2020-08-10T00:00:00Z", removed["a-1.0-1"])
+}
+
+func TestFilterRepodataByAllowedRetention(t *testing.T) {
+	repodata := &Repodata{
+		RepodataVersion: 1,
+		Info:            RepodataInfo{Subdir: "noarch"},
+		Packages: map[string]RepodataRecord{
+			"a-1-0.tar.bz2": {Subdir: "noarch", Name: "a", Version: "1", Build: "0"},
+			"a-2-0.tar.bz2": {Subdir: "noarch", Name: "a", Version: "2", Build: "0"},
+		},
+		PackagesConda: map[string]RepodataRecord{
+			"a-2-0.conda": {Subdir: "noarch", Name: "a", Version: "2", Build: "0"},
+			"b-1-0.conda": {Subdir: "noarch", Name: "b", Version: "1", Build: "0"},
+		},
+	}
+	filtered, exclusions := FilterRepodataByAllowed(repodata, &FilterPolicy{Retention: &RetentionPolicy{KeepVersions: 1}})
+
+	assert.Equal(t, 1, len(filtered.Packages))
+	assert.Contains(t, filtered.Packages, "a-2-0.tar.bz2")
+	assert.Equal(t, 2, len(filtered.PackagesConda))
+	assert.Equal(t, []Exclusion{{"a-1-0.tar.bz2", repodata.Packages["a-1-0.tar.bz2"], RuleRetention, "not in newest 1 versions"}}, exclusions)
+}
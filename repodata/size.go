@@ -0,0 +1,54 @@
+// Package size limits
+package repodata
+
+import (
+	"errors"
+	"fmt"
+)
+
+const megabyte = 1024 * 1024
+
+// SizePolicy excludes records whose package file is larger than a limit
+type SizePolicy struct {
+	// Maximum size in bytes, 0 for no limit
+	max int64
+	// Maximum sizes in bytes for named packages, 0 for no limit
+	overrides map[string]int64
+}
+
+// NewSizePolicy creates a size policy from limits in MB, 0 for no limit
+//
+// overrides maps package names to their own limits.
+func NewSizePolicy(maxMB int, overrides map[string]int) (*SizePolicy, error) {
+	if maxMB < 0 {
+		return nil, errors.New("invalid maximum package size: " + fmt.Sprint(maxMB))
+	}
+	p := &SizePolicy{
+		max:       int64(maxMB) * megabyte,
+		overrides: make(map[string]int64),
+	}
+	for name, mb := range overrides {
+		if mb < 0 {
+			return nil, fmt.Errorf("invalid maximum package size for %s: %d", name, mb)
+		}
+		p.overrides[name] = int64(mb) * megabyte
+	}
+	return p, nil
+}
+
+// Limit returns the maximum size in bytes of a package, 0 for no limit
+func (p *SizePolicy) Limit(name string) int64 {
+	if limit, ok := p.overrides[name]; ok {
+		return limit
+	}
+	return p.max
+}
+
+// Check returns true if the record's size is within the limit, and a reason if it isn't
+func (p *SizePolicy) Check(record *RepodataRecord) (bool, string) {
+	limit := p.Limit(record.Name)
+	if limit > 0 && int64(record.Size) > limit {
+		return false, fmt.Sprintf("size %.1f MB > %d MB", float64(record.Size)/megabyte, limit/megabyte)
+	}
+	return true, ""
+}
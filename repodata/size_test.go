@@ -0,0 +1,51 @@
+package repodata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSizePolicyInvalid(t *testing.T) {
+	_, err := NewSizePolicy(-1, nil)
+	assert.EqualError(t, err, "invalid maximum package size: -1")
+	_, err = NewSizePolicy(100, map[string]int{"pytorch": -1})
+	assert.EqualError(t, err, "invalid maximum package size for pytorch: -1")
+}
+
+func TestSizePolicyCheck(t *testing.T) {
+	policy, err := NewSizePolicy(100, map[string]int{"pytorch": 2000, "cudatoolkit": 0})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		name    string
+		size    int
+		allowed bool
+		reason  string
+	}{
+		{"numpy", 8 * megabyte, true, ""},
+		{"numpy", 100 * megabyte, true, ""},
+		{"numpy", 100*megabyte + 1, false, "size 100.0 MB > 100 MB"},
+		{"libcublas", 380 * megabyte, false, "size 380.0 MB > 100 MB"},
+		{"pytorch", 1500 * megabyte, true, ""},
+		{"pytorch", 2500 * megabyte, false, "size 2500.0 MB > 2000 MB"},
+		{"cudatoolkit", 5000 * megabyte, true, ""},
+	}
+	for _, tc := range testCases {
+		allowed, reason := policy.Check(&RepodataRecord{Name: tc.name, Size: tc.size})
+		assert.Equal(t, tc.allowed, allowed, tc.name)
+		assert.Equal(t, tc.reason, reason, tc.name)
+	}
+
+	unlimited, err := NewSizePolicy(0, map[string]int{"pytorch": 2000})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, int64(0), unlimited.Limit("numpy"))
+	allowed, _ := unlimited.Check(&RepodataRecord{Name: "numpy", Size: 5000 * megabyte})
+	assert.True(t, allowed)
+	allowed, _ = unlimited.Check(&RepodataRecord{Name: "pytorch", Size: 2500 * megabyte})
+	assert.False(t, allowed)
+}
@@ -0,0 +1,155 @@
+package repodata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned if a package doesn't match its checksums
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// PackageChecksum is the expected size and sha256 of a package file
+type PackageChecksum struct {
+	Size   int64
+	Sha256 string
+}
+
+// PackageChecksums returns the checksums of the records in repodata, indexed
+// by "channel/subdir/filename"
+func PackageChecksums(channel string, repodata *Repodata) map[string]PackageChecksum {
+	checksums := make(map[string]PackageChecksum)
+	for _, packages := range []map[string]RepodataRecord{repodata.Packages, repodata.PackagesConda} {
+		for k, v := range packages {
+			checksums[channel+"/"+v.Subdir+"/"+k] = PackageChecksum{
+				Size:   int64(v.Size),
+				Sha256: strings.ToLower(v.Sha256),
+			}
+		}
+	}
+	return checksums
+}
+
+// LoadPackageChecksums loads the checksums written by conda-parser, each line
+// is "channel/subdir/filename<TAB>size<TAB>sha256"
+func LoadPackageChecksums(filename string) (map[string]PackageChecksum, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]PackageChecksum)
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected 3 fields: %s", filename, i+1, line)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid size: %s", filename, i+1, fields[1])
+		}
+		checksums[fields[0]] = PackageChecksum{Size: size, Sha256: strings.ToLower(fields[2])}
+	}
+	return checksums, nil
+}
+
+// String formats a PackageChecksum as "size<TAB>sha256"
+func (c PackageChecksum) String() string {
+	return fmt.Sprintf("%d\t%s", c.Size, c.Sha256)
+}
+
+// CopyVerified copies a package from src to dst, checking its size and sha256
+//
+// The last byte is held back until the whole package has been checked, so if
+// an error is returned dst has an incomplete package. Whichever of the size and
+// sha256 are known are checked, at least one is required. Returns the number of
+// bytes written.
+func CopyVerified(dst io.Writer, src io.Reader, expected PackageChecksum) (int64, error) {
+	if expected.Size <= 0 {
+		if expected.Sha256 == "" {
+			return 0, errors.New("size or sha256 is required")
+		}
+		return copySha256Verified(dst, src, expected.Sha256)
+	}
+	hash := sha256.New()
+	tee := io.TeeReader(src, hash)
+
+	written, err := io.CopyN(dst, tee, expected.Size-1)
+	if err == io.EOF {
+		return written, fmt.Errorf("%w: size %d != %d", ErrChecksumMismatch, written, expected.Size)
+	}
+	if err != nil {
+		return written, err
+	}
+
+	last := make([]byte, 2)
+	n, err := io.ReadFull(tee, last)
+	switch {
+	case err == nil:
+		return written, fmt.Errorf("%w: size more than %d", ErrChecksumMismatch, expected.Size)
+	case n == 0 && err == io.EOF:
+		return written, fmt.Errorf("%w: size %d != %d", ErrChecksumMismatch, written, expected.Size)
+	case err != io.ErrUnexpectedEOF:
+		return written, err
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); expected.Sha256 != "" && sum != expected.Sha256 {
+		return written, fmt.Errorf("%w: sha256 %s != %s", ErrChecksumMismatch, sum, expected.Sha256)
+	}
+	n, err = dst.Write(last[:1])
+	return written + int64(n), err
+}
+
+// copySha256Verified copies a package of unknown size from src to dst, holding
+// back the last byte until its sha256 has been checked
+func copySha256Verified(dst io.Writer, src io.Reader, expected string) (int64, error) {
+	hash := sha256.New()
+	w := &holdLastByteWriter{w: dst}
+	if _, err := io.Copy(w, io.TeeReader(src, hash)); err != nil {
+		return w.written, err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != expected {
+		return w.written, fmt.Errorf("%w: sha256 %s != %s", ErrChecksumMismatch, sum, expected)
+	}
+	if !w.held {
+		return w.written, nil
+	}
+	n, err := dst.Write(w.last[:])
+	return w.written + int64(n), err
+}
+
+// holdLastByteWriter writes everything except the last byte written to it
+type holdLastByteWriter struct {
+	w       io.Writer
+	last    [1]byte
+	held    bool
+	written int64
+}
+
+func (h *holdLastByteWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if h.held {
+		n, err := h.w.Write(h.last[:])
+		h.written += int64(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := h.w.Write(p[:len(p)-1])
+	h.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	h.last[0] = p[len(p)-1]
+	h.held = true
+	return len(p), nil
+}
@@ -0,0 +1,91 @@
+package repodata
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackageChecksums(t *testing.T) {
+	repodata := &Repodata{
+		Packages: map[string]RepodataRecord{
+			"a-1-0.tar.bz2": {Subdir: "noarch", Size: 10, Sha256: "ABCD"},
+		},
+		PackagesConda: map[string]RepodataRecord{
+			"a-1-0.conda": {Subdir: "noarch", Size: 5, Sha256: "abcd"},
+		},
+	}
+	assert.Equal(t, map[string]PackageChecksum{
+		"conda-forge/noarch/a-1-0.tar.bz2": {10, "abcd"},
+		"conda-forge/noarch/a-1-0.conda":   {5, "abcd"},
+	}, PackageChecksums("conda-forge", repodata))
+}
+
+func TestCopyVerified(t *testing.T) {
+	// echo -n hello | sha256sum
+	helloSha256 := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	testCases := []struct {
+		name     string
+		content  string
+		expected PackageChecksum
+		written  string
+		err      string
+	}{
+		{"valid", "hello", PackageChecksum{5, helloSha256}, "hello", ""},
+		{"no sha256", "hello", PackageChecksum{5, ""}, "hello", ""},
+		{"sha256 mismatch", "jello", PackageChecksum{5, helloSha256}, "jell", "checksum mismatch: sha256 "},
+		{"too short", "hell", PackageChecksum{5, helloSha256}, "hell", "checksum mismatch: size 4 != 5"},
+		{"much too short", "he", PackageChecksum{5, helloSha256}, "he", "checksum mismatch: size 2 != 5"},
+		{"too long", "hello!", PackageChecksum{5, helloSha256}, "hell", "checksum mismatch: size more than 5"},
+		{"no size", "hello", PackageChecksum{0, helloSha256}, "hello", ""},
+		{"no size sha256 mismatch", "hello!", PackageChecksum{0, helloSha256}, "hello", "checksum mismatch: sha256 "},
+		{"no size empty", "", PackageChecksum{0, helloSha256}, "", "checksum mismatch: sha256 "},
+		{"no checksum", "hello", PackageChecksum{0, ""}, "", "size or sha256 is required"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var dst bytes.Buffer
+			n, err := CopyVerified(&dst, strings.NewReader(tc.content), tc.expected)
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.err)
+				assert.Equal(t, tc.expected != PackageChecksum{}, errors.Is(err, ErrChecksumMismatch))
+			}
+			assert.Equal(t, tc.written, dst.String())
+			assert.Equal(t, int64(len(tc.written)), n)
+		})
+	}
+}
+
+func TestLoadPackageChecksums(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "checksums.txt")
+	checksum := PackageChecksum{10, "ABCD"}
+	if err := os.WriteFile(filename, []byte("conda-forge/noarch/a-1-0.tar.bz2\t"+checksum.String()+"\nconda-forge/noarch/a-1-0.conda\t0\t\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	checksums, err := LoadPackageChecksums(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]PackageChecksum{
+		"conda-forge/noarch/a-1-0.tar.bz2": {10, "abcd"},
+		"conda-forge/noarch/a-1-0.conda":   {0, ""},
+	}, checksums)
+
+	if err := os.WriteFile(filename, []byte("conda-forge/noarch/a-1-0.tar.bz2\tx\tabcd\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = LoadPackageChecksums(filename)
+	assert.EqualError(t, err, filename+":1: invalid size: x")
+
+	if err := os.WriteFile(filename, []byte("conda-forge/noarch/a-1-0.tar.bz2\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = LoadPackageChecksums(filename)
+	assert.EqualError(t, err, filename+":1: expected 3 fields: conda-forge/noarch/a-1-0.tar.bz2")
+}
@@ -0,0 +1,238 @@
+// Conda version ordering
+// https://github.com/conda/conda/blob/23.7.2/conda/models/version.py
+package repodata
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+type versionComponentKind int
+
+// The order of these kinds matters, strings sort before numbers, and "post"
+// sorts after everything
+const (
+	componentDev versionComponentKind = iota
+	componentString
+	componentNumber
+	componentPost
+)
+
+// versionComponent is a run of digits or non-digits in a version segment
+type versionComponent struct {
+	kind versionComponentKind
+	// Numbers are stored as strings without leading zeros so they can be any length
+	value string
+}
+
+var versionZero = versionComponent{componentNumber, "0"}
+
+func compareComponents(a, b versionComponent) int {
+	if a.kind != b.kind {
+		if a.kind < b.kind {
+			return -1
+		}
+		return 1
+	}
+	switch a.kind {
+	case componentNumber:
+		if len(a.value) != len(b.value) {
+			if len(a.value) < len(b.value) {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.value, b.value)
+	case componentString:
+		return strings.Compare(a.value, b.value)
+	}
+	return 0
+}
+
+// Version is a parsed conda version that can be compared with other versions
+type Version struct {
+	// Original version string
+	raw     string
+	version [][]versionComponent
+	local   [][]versionComponent
+}
+
+var versionSplitRe = regexp.MustCompile(`[0-9]+|[*]+|[^0-9*]+`)
+var versionInvalidRe = regexp.MustCompile(`[^a-z0-9_.+!*]`)
+
+func parseVersionSegments(segments []string) ([][]versionComponent, error) {
+	parsed := make([][]versionComponent, 0, len(segments))
+	for _, segment := range segments {
+		parts := versionSplitRe.FindAllString(segment, -1)
+		if len(parts) == 0 {
+			return nil, errors.New("empty version component")
+		}
+		components := []versionComponent{}
+		// Components must start with a number
+		if parts[0][0] < '0' || parts[0][0] > '9' {
+			components = append(components, versionZero)
+		}
+		for _, part := range parts {
+			switch {
+			case part[0] >= '0' && part[0] <= '9':
+				number := strings.TrimLeft(part, "0")
+				if number == "" {
+					number = "0"
+				}
+				components = append(components, versionComponent{componentNumber, number})
+			case part == "post":
+				components = append(components, versionComponent{componentPost, part})
+			case part == "dev":
+				components = append(components, versionComponent{componentDev, part})
+			default:
+				components = append(components, versionComponent{componentString, part})
+			}
+		}
+		parsed = append(parsed, components)
+	}
+	return parsed, nil
+}
+
+// ParseVersion parses a conda version string such as "1.2.3", "1!2.0rc1" or "1.0+local.1"
+func ParseVersion(v string) (*Version, error) {
+	normalised := strings.ToLower(strings.TrimSpace(v))
+	if normalised == "" {
+		return nil, errors.New("empty version string")
+	}
+	if strings.Contains(normalised, "-") && !strings.Contains(normalised, "_") {
+		normalised = strings.ReplaceAll(normalised, "-", "_")
+	}
+	if versionInvalidRe.MatchString(normalised) {
+		return nil, errors.New("invalid character(s) in version: " + v)
+	}
+
+	epoch := "0"
+	if parts := strings.Split(normalised, "!"); len(parts) == 2 {
+		epoch = parts[0]
+		normalised = parts[1]
+	} else if len(parts) > 2 {
+		return nil, errors.New("duplicated epoch separator '!' in version: " + v)
+	}
+
+	local := ""
+	if parts := strings.Split(normalised, "+"); len(parts) == 2 {
+		normalised = parts[0]
+		local = parts[1]
+	} else if len(parts) > 2 {
+		return nil, errors.New("duplicated local version separator '+' in version: " + v)
+	}
+
+	segments := []string{epoch}
+	if strings.HasSuffix(normalised, "_") {
+		// A trailing underscore is kept as part of the last component, e.g. 1.1_ is
+		// a pre-release of 1.1a (openssl style versions)
+		split := strings.Split(strings.ReplaceAll(normalised[:len(normalised)-1], "_", "."), ".")
+		split[len(split)-1] += "_"
+		segments = append(segments, split...)
+	} else {
+		segments = append(segments, strings.Split(strings.ReplaceAll(normalised, "_", "."), ".")...)
+	}
+	version, err := parseVersionSegments(segments)
+	if err != nil {
+		return nil, errors.New("invalid version " + v + ": " + err.Error())
+	}
+
+	parsed := &Version{raw: v, version: version}
+	if local != "" {
+		parsed.local, err = parseVersionSegments(strings.Split(strings.ReplaceAll(local, "_", "."), "."))
+		if err != nil {
+			return nil, errors.New("invalid local version " + v + ": " + err.Error())
+		}
+	}
+	return parsed, nil
+}
+
+func (v *Version) String() string {
+	return v.raw
+}
+
+// compareSegments compares two lists of segments, padding the shorter with zeros
+func compareSegments(a, b [][]versionComponent) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var sa, sb []versionComponent
+		if i < len(a) {
+			sa = a[i]
+		}
+		if i < len(b) {
+			sb = b[i]
+		}
+		for j := 0; j < len(sa) || j < len(sb); j++ {
+			ca, cb := versionZero, versionZero
+			if j < len(sa) {
+				ca = sa[j]
+			}
+			if j < len(sb) {
+				cb = sb[j]
+			}
+			if c := compareComponents(ca, cb); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+// Compare returns -1 if v < other, 0 if they are equal, 1 if v > other
+func (v *Version) Compare(other *Version) int {
+	if c := compareSegments(v.version, other.version); c != 0 {
+		return c
+	}
+	return compareSegments(v.local, other.local)
+}
+
+// StartsWith returns true if v matches prefix up to the last component of prefix,
+// for example 1.2.3 starts with 1.2, but 1.20 does not
+func (v *Version) StartsWith(prefix *Version) bool {
+	t1, t2 := v.version, prefix.version
+	if len(prefix.local) > 0 {
+		if compareSegments(v.version, prefix.version) != 0 {
+			return false
+		}
+		t1, t2 = v.local, prefix.local
+	}
+
+	n := len(t2) - 1
+	if compareSegments(truncateSegments(t1, n), t2[:n]) != 0 {
+		return false
+	}
+
+	var s1 []versionComponent
+	if n < len(t1) {
+		s1 = t1[n]
+	}
+	s2 := t2[n]
+	m := len(s2) - 1
+	if compareSegments([][]versionComponent{truncateComponents(s1, m)}, [][]versionComponent{s2[:m]}) != 0 {
+		return false
+	}
+
+	c2 := s2[m]
+	if m >= len(s1) {
+		return false
+	}
+	c1 := s1[m]
+	if c2.kind == componentString || c2.kind == componentDev {
+		return (c1.kind == componentString || c1.kind == componentDev) && strings.HasPrefix(c1.value, c2.value)
+	}
+	return compareComponents(c1, c2) == 0
+}
+
+func truncateSegments(s [][]versionComponent, n int) [][]versionComponent {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func truncateComponents(c []versionComponent, n int) []versionComponent {
+	if len(c) > n {
+		return c[:n]
+	}
+	return c
+}
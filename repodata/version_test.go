@@ -0,0 +1,98 @@
+package repodata
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseVersion(t *testing.T, v string) *Version {
+	version, err := ParseVersion(v)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return version
+}
+
+func TestVersionOrder(t *testing.T) {
+	// Each version is less than the next, from the conda VersionOrder documentation
+	ordered := []string{
+		"0.4",
+		"0.4.1.rc",
+		"0.4.1",
+		"0.5a1",
+		"0.5b3",
+		"0.5C1",
+		"0.5",
+		"0.9.6",
+		"0.960923",
+		"1.0",
+		"1.1dev1",
+		"1.1_",
+		"1.1a1",
+		"1.1.0dev1",
+		"1.1.a1",
+		"1.1.0rc1",
+		"1.1.0",
+		"1.1.0post1",
+		"1.1post1",
+		"1996.07.12",
+		"1!0.4.1",
+		"1!3.1.1.6",
+		"2!0.4.1",
+	}
+	for i := 0; i < len(ordered)-1; i++ {
+		t.Run(fmt.Sprintf("%s<%s", ordered[i], ordered[i+1]), func(t *testing.T) {
+			a := mustParseVersion(t, ordered[i])
+			b := mustParseVersion(t, ordered[i+1])
+			assert.Equal(t, -1, a.Compare(b))
+			assert.Equal(t, 1, b.Compare(a))
+		})
+	}
+}
+
+func TestVersionEqual(t *testing.T) {
+	testCases := [][2]string{
+		{"1.0", "1.0.0"},
+		{"0.4.1.rc", "0.4.1.RC"},
+		{"1.2.3", "0!1.2.3"},
+		{"1.2-3", "1.2_3"},
+		{"20230805", "020230805"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s==%s", tc[0], tc[1]), func(t *testing.T) {
+			assert.Equal(t, 0, mustParseVersion(t, tc[0]).Compare(mustParseVersion(t, tc[1])))
+		})
+	}
+}
+
+func TestVersionStartsWith(t *testing.T) {
+	testCases := []struct {
+		version  string
+		prefix   string
+		expected bool
+	}{
+		{"1.2.3", "1.2", true},
+		{"1.2", "1.2", true},
+		{"1.20", "1.2", false},
+		{"1.2.3", "1.3", false},
+		{"1.2a1", "1.2a", true},
+		{"1.2", "1.2.0", false},
+		{"1.2.3+local", "1.2.3+loc", true},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s,%s", tc.version, tc.prefix), func(t *testing.T) {
+			assert.Equal(t, tc.expected, mustParseVersion(t, tc.version).StartsWith(mustParseVersion(t, tc.prefix)))
+		})
+	}
+}
+
+func TestParseVersionInvalid(t *testing.T) {
+	for _, v := range []string{"", "1.2!3!4", "1.2+a+b", "1.2 3", "1..2"} {
+		t.Run(v, func(t *testing.T) {
+			_, err := ParseVersion(v)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+// Target platform profiles based on virtual packages
+// https://docs.conda.io/projects/conda/en/latest/user-guide/tasks/manage-virtual.html
+package repodata
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+// isVirtualPackage returns true for virtual packages such as __glibc
+func isVirtualPackage(dependency string) bool {
+	return strings.HasPrefix(dependency, "__")
+}
+
+// VirtualPackageProfile is the set of virtual packages available on a target platform
+//
+// Only declared virtual packages and virtual packages that are known to be
+// unavailable are checked, dependencies on other virtual packages are always
+// satisfied. The profile is not safe for concurrent use.
+type VirtualPackageProfile struct {
+	versions map[string]*Version
+	// Virtual packages that are never available, e.g. __win on linux-64
+	unavailable map[string]bool
+	// Parsed virtual package dependencies, cached since many records share them
+	specs map[string]*MatchSpec
+}
+
+// NewVirtualPackageProfile creates a profile from a map of virtual package names
+// to versions, e.g. `__glibc: 2.17`. An empty version declares a virtual package
+// such as `__unix` that has no meaningful version.
+func NewVirtualPackageProfile(versions map[string]string) (*VirtualPackageProfile, error) {
+	p := &VirtualPackageProfile{
+		versions:    make(map[string]*Version),
+		unavailable: make(map[string]bool),
+		specs:       make(map[string]*MatchSpec),
+	}
+	for name, version := range versions {
+		if !isVirtualPackage(name) {
+			return nil, errors.New("virtual package names must start with __: " + name)
+		}
+		if version == "" {
+			version = "0"
+		}
+		v, err := ParseVersion(version)
+		if err != nil {
+			return nil, errors.New("invalid version for " + name + ": " + err.Error())
+		}
+		p.versions[name] = v
+	}
+	return p, nil
+}
+
+// unavailableVirtualPackages returns the operating system virtual packages that
+// can't be installed on a platform subdir
+func unavailableVirtualPackages(subdir string) []string {
+	platform, _, _ := strings.Cut(subdir, "-")
+	switch platform {
+	case "linux":
+		return []string{"__osx", "__win"}
+	case "osx":
+		return []string{"__glibc", "__linux", "__win"}
+	case "win":
+		return []string{"__glibc", "__linux", "__osx", "__unix"}
+	}
+	return nil
+}
+
+// NewPlatformVirtualPackageProfiles creates a profile for each platform subdir
+// from a map of subdirs to virtual package versions
+//
+// Platform profiles also exclude the operating system virtual packages of other
+// platforms, e.g. __win on linux-64, unless they're declared. Profiles in
+// versions for subdirs that aren't in subdirs are also created.
+func NewPlatformVirtualPackageProfiles(subdirs []string, versions map[string]map[string]string) (map[string]*VirtualPackageProfile, error) {
+	profiles := make(map[string]*VirtualPackageProfile)
+	for subdir, v := range versions {
+		p, err := NewVirtualPackageProfile(v)
+		if err != nil {
+			return nil, errors.New(subdir + ": " + err.Error())
+		}
+		profiles[subdir] = p
+	}
+	for _, subdir := range subdirs {
+		if subdir == "noarch" {
+			continue
+		}
+		if _, ok := profiles[subdir]; !ok {
+			profiles[subdir], _ = NewVirtualPackageProfile(nil)
+		}
+		p := profiles[subdir]
+		for _, name := range unavailableVirtualPackages(subdir) {
+			if _, declared := p.versions[name]; !declared {
+				p.unavailable[name] = true
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// Check returns the first virtual package dependency of a record that isn't
+// satisfied by the profile, or an empty string
+func (p *VirtualPackageProfile) Check(record *RepodataRecord) string {
+	for _, dep := range record.Depends {
+		if !isVirtualPackage(dep) {
+			continue
+		}
+		spec, ok := p.specs[dep]
+		if !ok {
+			var err error
+			spec, err = ParseMatchSpec(dep)
+			if err != nil {
+				log.Printf("Ignoring invalid dependency %s: %s", dep, err)
+			}
+			p.specs[dep] = spec
+		}
+		if spec == nil {
+			continue
+		}
+		if p.unavailable[spec.Name] {
+			return dep
+		}
+		version, declared := p.versions[spec.Name]
+		if !declared {
+			continue
+		}
+		// Virtual package build strings aren't meaningful so only the version is checked
+		if spec.Version != nil && !spec.Version.Matches(version) {
+			return dep
+		}
+	}
+	return ""
+}
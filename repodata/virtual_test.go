@@ -0,0 +1,80 @@
+package repodata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewVirtualPackageProfileInvalid(t *testing.T) {
+	_, err := NewVirtualPackageProfile(map[string]string{"glibc": "2.17"})
+	assert.Error(t, err)
+
+	_, err = NewVirtualPackageProfile(map[string]string{"__glibc": "2..17"})
+	assert.Error(t, err)
+}
+
+func TestVirtualPackageProfileCheck(t *testing.T) {
+	profile, err := NewVirtualPackageProfile(map[string]string{
+		"__glibc": "2.17",
+		"__cuda":  "12.2",
+		"__unix":  "",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		depends  []string
+		expected string
+	}{
+		{[]string{"python >=3.10"}, ""},
+		{[]string{"__glibc >=2.17,<3.0.a0"}, ""},
+		{[]string{"libgcc-ng >=12", "__glibc >=2.28,<3.0.a0"}, "__glibc >=2.28,<3.0.a0"},
+		{[]string{"__cuda >=12"}, ""},
+		{[]string{"__cuda >=12.4"}, "__cuda >=12.4"},
+		{[]string{"__unix"}, ""},
+		{[]string{"__unix * 0"}, ""},
+		// Undeclared virtual packages are not checked
+		{[]string{"__osx >=11"}, ""},
+		{[]string{"__win"}, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			assert.Equal(t, tc.expected, profile.Check(&RepodataRecord{Name: "a", Depends: tc.depends}))
+		})
+	}
+}
+
+func TestNewPlatformVirtualPackageProfiles(t *testing.T) {
+	profiles, err := NewPlatformVirtualPackageProfiles(
+		[]string{"linux-64", "osx-arm64", "win-64", "noarch"},
+		map[string]map[string]string{"linux-64": {"__glibc": "2.17"}, "osx-arm64": {"__osx": "11.0"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assert.Equal(t, 3, len(profiles))
+
+	testCases := []struct {
+		subdir   string
+		depends  []string
+		expected string
+	}{
+		{"linux-64", []string{"__glibc >=2.28"}, "__glibc >=2.28"},
+		{"linux-64", []string{"__unix", "__linux"}, ""},
+		{"linux-64", []string{"__win"}, "__win"},
+		{"osx-arm64", []string{"__unix", "__osx >=10.13"}, ""},
+		{"osx-arm64", []string{"__glibc >=2.17"}, "__glibc >=2.17"},
+		{"win-64", []string{"__win"}, ""},
+		{"win-64", []string{"__unix"}, "__unix"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.subdir+"-"+tc.expected, func(t *testing.T) {
+			assert.Equal(t, tc.expected, profiles[tc.subdir].Check(&RepodataRecord{Name: "a", Depends: tc.depends}))
+		})
+	}
+
+	_, err = NewPlatformVirtualPackageProfiles(nil, map[string]map[string]string{"linux-64": {"glibc": "2.17"}})
+	assert.EqualError(t, err, "linux-64: virtual package names must start with __: glibc")
+}